@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
@@ -22,19 +25,46 @@ func main() {
 	handleFuncs("/analytics/*", false, Handlers{methods.GET: analytics, methods.POST: analytics})
 	handleFuncs("/braintree", false, Handlers{methods.GET: braintreeToken, methods.POST: braintreeCheckout})
 	handleFuncs("/channels/{id}", false, Handlers{methods.DELETE: channelDelete, methods.POST: channelSetup})
+	handleFuncs("/channels/{id}/close", false, Handlers{methods.POST: channelClose})
+	handleFuncs("/channels/{id}/rendezvous", false, Handlers{methods.POST: channelRendezvous})
+	handleFuncs("/channels/{id}/status", false, Handlers{methods.GET: channelStatus})
+	handleFuncs("/cleanupchannels", true, Handlers{methods.GET: cleanUpExpiredChannels})
+	handleFuncs("/cleanupredoxlogs", true, Handlers{methods.GET: cleanUpRedoxRequestLogs})
 	handleFuncs("/continent", false, Handlers{methods.GET: getContinent})
 	handleFuncs("/downgradeaccount/{userToken}", false, Handlers{methods.GET: downgradeAccount})
+	handleFuncs("/fhir/Appointment", false, Handlers{methods.GET: fhirSearchAppointments})
+	handleFuncs("/fhir/Appointment/{id}", false, Handlers{methods.GET: fhirReadAppointment})
+	handleFuncs("/fhir/Patient", false, Handlers{methods.GET: fhirSearchPatients})
+	handleFuncs("/fhir/Patient/{id}", false, Handlers{methods.GET: fhirReadPatient})
+	handleFuncs("/fhir/Practitioner", false, Handlers{methods.GET: fhirSearchPractitioners})
+	handleFuncs("/fhir/Practitioner/{id}", false, Handlers{methods.GET: fhirReadPractitioner})
 	handleFuncs("/geolocation/{language}", false, Handlers{methods.GET: getGeolocation})
 	handleFuncs("/iceservers", false, Handlers{methods.GET: getIceServers})
+	handleFuncs("/ipfs/gateways", false, Handlers{methods.GET: getIPFSGatewayStatuses})
+	handleFuncs("/ipfs/gateways/check", false, Handlers{methods.POST: checkIPFSGatewayHandler})
+	handleFuncs("/ipfs/gateways/drain", false, Handlers{methods.POST: drainIPFSGateway})
+	handleFuncs("/ipfs/gateways/enable", false, Handlers{methods.POST: enableIPFSGateway})
 	handleFuncs("/package/*", false, Handlers{methods.GET: getPackage})
+	handleFuncs("/packages/reload", false, Handlers{methods.POST: reloadPackages})
+	handleFuncs("/packages/rollback", false, Handlers{methods.POST: rollBackPackage})
 	handleFuncs("/packagetimestamp/*", false, Handlers{methods.GET: getPackageTimestamp})
+	handleFuncs("/packageversions/*", false, Handlers{methods.GET: getPackageVersions})
 	handleFuncs("/preauth/{id}", false, Handlers{methods.POST: preAuth})
 	handleFuncs("/pro/unlock", false, Handlers{methods.POST: proUnlock})
 	handleFuncs("/redox/apikey/delete", false, Handlers{methods.POST: redoxDeleteAPIKey})
 	handleFuncs("/redox/apikey/generate", false, Handlers{methods.POST: redoxGenerateAPIKey})
+	handleFuncs("/redox/apikey/list", false, Handlers{methods.POST: redoxListAPIKeys})
+	handleFuncs("/redox/apikey/update", false, Handlers{methods.POST: redoxUpdateAPIKey})
 	handleFuncs("/redox/apikey/verify", false, Handlers{methods.POST: redoxVerifyAPIKey})
 	handleFuncs("/redox/credentials", false, Handlers{methods.PUT: redoxAddCredentials})
+	handleFuncs("/redox/events", false, Handlers{methods.POST: redoxListEvents})
 	handleFuncs("/redox/execute", false, Handlers{methods.POST: redoxRunCommand})
+	handleFuncs("/redox/limits", false, Handlers{methods.POST: redoxSetLimits})
+	handleFuncs("/redox/logs", false, Handlers{methods.POST: redoxListRequestLogs})
+	handleFuncs("/redox/reencrypt", false, Handlers{methods.POST: redoxReencrypt})
+	handleFuncs("/redox/usage", false, Handlers{methods.POST: redoxGetUsage})
+	handleFuncs("/redox/webhook", false, Handlers{methods.POST: redoxSetUpWebhook})
+	handleFuncs("/redox/webhook/{id}", false, Handlers{methods.POST: redoxReceiveWebhook})
 	handleFuncs("/signups", false, Handlers{methods.PUT: signUp})
 	handleFuncs("/timestamp", false, Handlers{methods.GET: getTimestampHandler})
 	handleFuncs("/waitlist/invite", true, Handlers{methods.GET: rollOutWaitlistInvites})
@@ -45,13 +75,14 @@ func main() {
 		return "Welcome to Cyph, lad", http.StatusOK
 	})
 
+	go monitorIPFSGateways()
+	go watchPackageDatabase()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "443"
 	}
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
-
-	checkAllIPFSGateways(false)
 }
 
 func analytics(h HandlerArgs) (interface{}, int) {
@@ -660,6 +691,61 @@ func braintreeToken(h HandlerArgs) (interface{}, int) {
 	return braintreeToken(h)
 }
 
+func channelClose(h HandlerArgs) (interface{}, int) {
+	id := sanitize(h.Vars["id"])
+
+	if !isValidCyphID(id) {
+		return "invalid ID", http.StatusForbidden
+	}
+
+	ownerKey := h.Request.PostFormValue("ownerKey")
+	status := http.StatusOK
+
+	for {
+		_, transactionErr := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+			burnerChannel := &BurnerChannel{}
+			burnerChannelKey := datastoreKey("BurnerChannel", id)
+
+			if err := datastoreTransaction.Get(burnerChannelKey, burnerChannel); err != nil {
+				status = http.StatusNotFound
+				return nil
+			}
+
+			if ownerKey == "" ||
+				burnerChannel.OwnerKeyHash == "" ||
+				subtle.ConstantTimeCompare(
+					[]byte(hashBurnerChannelOwnerKey(ownerKey)),
+					[]byte(burnerChannel.OwnerKeyHash),
+				) != 1 {
+				status = http.StatusForbidden
+				return nil
+			}
+
+			status = http.StatusOK
+
+			if _, err := datastoreTransaction.Put(burnerChannelKey, &BurnerChannel{ID: id}); err != nil {
+				datastoreTransaction.Rollback()
+				return err
+			}
+
+			return nil
+		})
+
+		if transactionErr == nil {
+			break
+		}
+	}
+
+	if status == http.StatusForbidden {
+		return "invalid owner key", status
+	}
+	if status == http.StatusNotFound {
+		return "channel not found", status
+	}
+
+	return "", status
+}
+
 func channelDelete(h HandlerArgs) (interface{}, int) {
 	id := sanitize(h.Vars["id"])
 
@@ -669,6 +755,14 @@ func channelDelete(h HandlerArgs) (interface{}, int) {
 
 	burnerChannelKey := datastoreKey("BurnerChannel", id)
 
+	/* Joiners delete on connect, so a group channel stays open until closed */
+	burnerChannel := &BurnerChannel{}
+	if err := h.Datastore.Get(h.Context, burnerChannelKey, burnerChannel); err == nil &&
+		burnerChannel.ChannelID != "" &&
+		isGroupBurnerChannel(burnerChannel) {
+		return "group channel must be closed by its initiator", http.StatusForbidden
+	}
+
 	emptyBurnerChannel := &BurnerChannel{
 		ChannelID: "",
 		ID:        id,
@@ -686,6 +780,32 @@ func channelDelete(h HandlerArgs) (interface{}, int) {
 	return "", http.StatusOK
 }
 
+func channelRendezvous(h HandlerArgs) (interface{}, int) {
+	id := sanitize(h.Vars["id"])
+
+	if !isValidCyphID(id) {
+		return "invalid ID", http.StatusForbidden
+	}
+
+	channelID := sanitize(h.Request.PostFormValue("channelID"))
+
+	joinTimestamp, err := waitForBurnerChannelJoin(h, id, channelID, config.BurnerChannelWaitTimeout)
+
+	if err == errBurnerChannelNotFound {
+		return err.Error(), http.StatusNotFound
+	}
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	/* Not joined yet; client should poll again */
+	if joinTimestamp == 0 {
+		return nil, http.StatusNoContent
+	}
+
+	return map[string]int64{"joinTimestamp": joinTimestamp}, http.StatusOK
+}
+
 func channelSetup(h HandlerArgs) (interface{}, int) {
 	/* Block Facebook tampering with links sent through Messenger */
 	org := getOrg(h)
@@ -706,10 +826,10 @@ func channelSetup(h HandlerArgs) (interface{}, int) {
 
 	err := h.Datastore.Get(h.Context, preAuthorizedCyphKey, preAuthorizedCyph)
 
-	/* Discard pre-authorization after two days */
-	if err == nil && now-preAuthorizedCyph.Timestamp > 172800000 {
-		h.Datastore.Delete(h.Context, preAuthorizedCyphKey)
-		return "pre-authorization expired", http.StatusForbidden
+	if err == nil {
+		if preAuthorizationError := getPreAuthorizationError(preAuthorizedCyph, now); preAuthorizationError != "" {
+			return preAuthorizationError, http.StatusForbidden
+		}
 	}
 
 	var preAuthorizedProFeatures map[string]bool
@@ -725,26 +845,70 @@ func channelSetup(h HandlerArgs) (interface{}, int) {
 	}
 
 	channelID := ""
+	missingOwnerKey := false
+	preAuthorizationError := ""
 	status := http.StatusOK
 
 	for {
 		_, transactionErr := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+			channelID = ""
+			missingOwnerKey = false
+			preAuthorizationError = ""
 			burnerChannel := &BurnerChannel{}
 			burnerChannelKey := datastoreKey("BurnerChannel", id)
 
 			datastoreTransaction.Get(burnerChannelKey, burnerChannel)
 
-			if now-burnerChannel.Timestamp > config.BurnerChannelExpiration {
+			if now-burnerChannel.Timestamp > getBurnerChannelLifetime(burnerChannel) {
 				burnerChannel = &BurnerChannel{}
 			}
 
+			/* Re-checked here so that concurrent joins can't exceed the allowed uses */
+			usedPreAuthorizedCyph := &PreAuthorizedCyph{}
+			isPreAuthorized := datastoreTransaction.Get(preAuthorizedCyphKey, usedPreAuthorizedCyph) == nil
+
+			if isPreAuthorized {
+				preAuthorizationError = getPreAuthorizationError(usedPreAuthorizedCyph, now)
+				if preAuthorizationError != "" {
+					return nil
+				}
+			}
+
 			if burnerChannel.ID != "" {
-				datastoreTransaction.Delete(preAuthorizedCyphKey)
+				isGroup := isGroupBurnerChannel(burnerChannel)
 
-				if now-burnerChannel.Timestamp < config.NewCyphTimeout {
+				if now-burnerChannel.Timestamp < getBurnerChannelLifetime(burnerChannel) &&
+					(!isGroup || int64(len(burnerChannel.JoinTimestamps)) < burnerChannel.MaxParticipants-1) {
 					channelID = burnerChannel.ChannelID
 				}
 
+				/* Only accepted joins count against the pre-authorization's uses; a used up one stays behind as a tombstone */
+				if channelID != "" && isPreAuthorized {
+					usedPreAuthorizedCyph.UseCount++
+
+					if _, err := datastoreTransaction.Put(preAuthorizedCyphKey, usedPreAuthorizedCyph); err != nil {
+						datastoreTransaction.Rollback()
+						return err
+					}
+				}
+
+				/*
+					Record each group join, or the first join of a two-party channel;
+					the first join also notifies a waiting initiator
+				*/
+				if channelID != "" && (isGroup || burnerChannel.JoinTimestamp == 0) {
+					if burnerChannel.JoinTimestamp == 0 {
+						burnerChannel.JoinTimestamp = now
+					}
+
+					burnerChannel.JoinTimestamps = append(burnerChannel.JoinTimestamps, now)
+
+					if _, err := datastoreTransaction.Put(burnerChannelKey, burnerChannel); err != nil {
+						datastoreTransaction.Rollback()
+						return err
+					}
+				}
+
 				burnerChannel.ChannelID = ""
 				burnerChannel.Timestamp = 0
 
@@ -768,6 +932,28 @@ func channelSetup(h HandlerArgs) (interface{}, int) {
 					burnerChannel.ID = id
 					burnerChannel.Timestamp = now
 
+					if isPreAuthorized && usedPreAuthorizedCyph.Lifetime > 0 {
+						burnerChannel.Lifetime = usedPreAuthorizedCyph.Timestamp + usedPreAuthorizedCyph.Lifetime - now
+					}
+
+					maxParticipants, err := strconv.ParseInt(sanitize(h.Request.FormValue("maxParticipants")), 10, 64)
+					if err == nil && maxParticipants > 2 {
+						if maxParticipants > config.MaxBurnerChannelParticipants {
+							maxParticipants = config.MaxBurnerChannelParticipants
+						}
+
+						/* Without an owner, nobody could close or delete the group before it expires */
+						ownerKey := h.Request.FormValue("ownerKey")
+						if ownerKey == "" {
+							channelID = ""
+							missingOwnerKey = true
+							return nil
+						}
+
+						burnerChannel.MaxParticipants = maxParticipants
+						burnerChannel.OwnerKeyHash = hashBurnerChannelOwnerKey(ownerKey)
+					}
+
 					if _, err := datastoreTransaction.Put(burnerChannelKey, burnerChannel); err != nil {
 						datastoreTransaction.Rollback()
 						return err
@@ -783,6 +969,14 @@ func channelSetup(h HandlerArgs) (interface{}, int) {
 		}
 	}
 
+	if preAuthorizationError != "" {
+		return preAuthorizationError, http.StatusForbidden
+	}
+
+	if missingOwnerKey {
+		return "group channels require an ownerKey", http.StatusBadRequest
+	}
+
 	if channelID == "" {
 		status = http.StatusNotFound
 	}
@@ -790,6 +984,140 @@ func channelSetup(h HandlerArgs) (interface{}, int) {
 	return channelID, status
 }
 
+func channelStatus(h HandlerArgs) (interface{}, int) {
+	id := sanitize(h.Vars["id"])
+
+	if !isValidCyphID(id) {
+		return "invalid ID", http.StatusForbidden
+	}
+
+	now := getTimestamp()
+
+	burnerChannel := &BurnerChannel{}
+	preAuthorizedCyph := &PreAuthorizedCyph{}
+
+	burnerChannelErr := h.Datastore.Get(h.Context, datastoreKey("BurnerChannel", id), burnerChannel)
+	if burnerChannelErr != nil && burnerChannelErr != datastore.ErrNoSuchEntity {
+		return burnerChannelErr.Error(), http.StatusInternalServerError
+	}
+
+	preAuthorizedCyphErr := h.Datastore.Get(h.Context, datastoreKey("PreAuthorizedCyph", id), preAuthorizedCyph)
+	if preAuthorizedCyphErr != nil && preAuthorizedCyphErr != datastore.ErrNoSuchEntity {
+		return preAuthorizedCyphErr.Error(), http.StatusInternalServerError
+	}
+
+	/* Never include the channel descriptor in this response */
+
+	age := int64(0)
+	state := "unclaimed"
+
+	if burnerChannelErr == datastore.ErrNoSuchEntity {
+		state = "notFound"
+	} else if burnerChannel.ChannelID == "" {
+		state = "deleted"
+	} else {
+		age = now - burnerChannel.Timestamp
+
+		if age > getBurnerChannelLifetime(burnerChannel) {
+			state = "expired"
+		} else if isGroupBurnerChannel(burnerChannel) {
+			if int64(len(burnerChannel.JoinTimestamps)) >= burnerChannel.MaxParticipants-1 {
+				state = "full"
+			}
+		} else if burnerChannel.JoinTimestamp != 0 {
+			state = "claimed"
+		}
+	}
+
+	return map[string]interface{}{
+		"age":             age,
+		"joinCount":       len(burnerChannel.JoinTimestamps),
+		"maxParticipants": burnerChannel.MaxParticipants,
+		"preAuthorized": preAuthorizedCyphErr == nil &&
+			getPreAuthorizationError(preAuthorizedCyph, now) == "",
+		"state": state,
+	}, http.StatusOK
+}
+
+/* Checks a gateway immediately, regardless of its circuit breaker */
+func checkIPFSGatewayHandler(h HandlerArgs) (interface{}, int) {
+	return updateIPFSGateway(h, func(gateway string) IPFSGatewayUptimeCheckData {
+		uptimeCheck := checkIPFSGatewayPackages(gateway, getMonitoredPackageUptimes())
+
+		if err := saveIPFSGatewayHealth(h, gateway); err != nil {
+			log.Printf("Failed to save health of IPFS gateway %s: %v", gateway, err)
+		}
+
+		return uptimeCheck
+	})
+}
+
+func cleanUpExpiredChannels(h HandlerArgs) (interface{}, int) {
+	now := getTimestamp()
+	deadline := time.Now().Add(config.ExpiredEntityCleanupTimeout)
+
+	/* Pre-authorized channels can outlive the default expiration */
+	burnerChannelCount, err := deleteExpiredEntities(
+		h,
+		"BurnerChannel",
+		now-getMaxPreAuthorizationLifetime(),
+		deadline,
+	)
+
+	if err != nil {
+		log.Printf("Failed to clean up burner channels in cleanUpExpiredChannels: %v", err)
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	preAuthorizedCyphCount, err := deleteExpiredEntities(
+		h,
+		"PreAuthorizedCyph",
+		now-getMaxPreAuthorizationLifetime()-config.PreAuthorizationTombstoneTTL,
+		deadline,
+	)
+
+	if err != nil {
+		log.Printf("Failed to clean up pre-authorizations in cleanUpExpiredChannels: %v", err)
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	return map[string]interface{}{
+		"burnerChannels":     burnerChannelCount,
+		"complete":           time.Now().Before(deadline),
+		"preAuthorizedCyphs": preAuthorizedCyphCount,
+	}, http.StatusOK
+}
+
+func cleanUpRedoxRequestLogs(h HandlerArgs) (interface{}, int) {
+	deadline := time.Now().Add(config.ExpiredEntityCleanupTimeout)
+
+	count, err := deleteExpiredEntities(
+		h,
+		"RedoxRequestLog",
+		getTimestamp()-config.RedoxRequestLogRetention,
+		deadline,
+	)
+
+	if err != nil {
+		log.Printf("Failed to clean up Redox request logs in cleanUpRedoxRequestLogs: %v", err)
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	eventCount, err := deleteExpiredEntities(
+		h,
+		"RedoxEvent",
+		getTimestamp()-config.RedoxEventRetention,
+		deadline,
+	)
+
+	if err != nil {
+		log.Printf("Failed to clean up Redox events in cleanUpRedoxRequestLogs: %v", err)
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	return map[string]int{"redoxEvents": eventCount, "redoxRequestLogs": count}, http.StatusOK
+}
+
 func downgradeAccount(h HandlerArgs) (interface{}, int) {
 	userToken := sanitize(h.Vars["userToken"])
 
@@ -820,122 +1148,418 @@ func downgradeAccount(h HandlerArgs) (interface{}, int) {
 	return true, http.StatusOK
 }
 
-func getContinent(h HandlerArgs) (interface{}, int) {
-	_, continentCode, _, _, _, _, _, _ := geolocate(h)
-	return continentCode, http.StatusOK
+func drainIPFSGateway(h HandlerArgs) (interface{}, int) {
+	return updateIPFSGateway(h, func(gateway string) IPFSGatewayUptimeCheckData {
+		return setIPFSGatewayDrained(h, gateway, true)
+	})
 }
 
-func getGeolocation(h HandlerArgs) (interface{}, int) {
-	// continent, continentCode, country, countryCode, city, postalCode, analID, firebaseRegion := geolocate(h)
-	_, _, _, countryCode, _, _, analID, firebaseRegion := geolocate(h)
-	// org := getOrg(h)
-
-	/* Return fields on an as-needed basis to avoid unnecessarily scaring users */
-	return map[string]string{
-		"analID": analID,
-		// "city":          city,
-		// "continent":     continent,
-		// "continentCode": continentCode,
-		// "country":       country,
-		"countryCode":    countryCode,
-		"firebaseRegion": firebaseRegion,
-		// "org":           org,
-		// "postalCode":    postalCode,
-	}, http.StatusOK
+func enableIPFSGateway(h HandlerArgs) (interface{}, int) {
+	return updateIPFSGateway(h, func(gateway string) IPFSGatewayUptimeCheckData {
+		return setIPFSGatewayDrained(h, gateway, false)
+	})
 }
 
-func getIceServers(h HandlerArgs) (interface{}, int) {
-	return getTwilioToken(h)["ice_servers"], http.StatusOK
-}
+func fhirReadAppointment(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
 
-func getPackage(h HandlerArgs) (interface{}, int) {
-	packageName := h.Request.URL.Path[9:]
-	packageData, ok := packages[packageName]
+	id := sanitize(h.Vars["id"])
+	now := getTimestamp()
 
-	if !ok {
-		return "package not found", http.StatusBadRequest
+	/* Reads only ever fetch the visits of the patient named in the ID */
+	patientID, _ := splitFHIRAppointmentID(id)
+	if patientID == "" {
+		return newFHIROperationOutcome("not-found", "Appointment/"+id+" not found"), http.StatusNotFound
 	}
 
-	_, continentCode, _, _, _, _, _, _ := geolocate(h)
+	appointments, outcome, responseCode := searchFHIRAppointments(
+		h,
+		now-config.FHIRAppointmentReadWindow,
+		now+config.FHIRAppointmentReadWindow,
+		patientID,
+	)
+	if outcome != nil {
+		return outcome, responseCode
+	}
 
-	return map[string]interface{}{
-		"gateways":  getIPFSGateways(continentCode),
-		"package":   packageData.Package,
-		"timestamp": packageData.Timestamp,
-	}, http.StatusOK
+	for _, appointment := range appointments {
+		if appointment["id"] == id {
+			return appointment, http.StatusOK
+		}
+	}
+
+	return newFHIROperationOutcome("not-found", "Appointment/"+id+" not found"), http.StatusNotFound
 }
 
-func getPackageTimestamp(h HandlerArgs) (interface{}, int) {
-	packageName := h.Request.URL.Path[18:]
-	packageData, ok := packages[packageName]
+func fhirReadPatient(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
 
-	if !ok {
-		return "package not found", http.StatusBadRequest
+	id := sanitize(h.Vars["id"])
+
+	response, outcome, responseCode := runFHIRRedoxQuery(h, "PatientSearch", "Query", map[string]interface{}{
+		"Patient": map[string]interface{}{
+			"Identifiers": []interface{}{
+				map[string]interface{}{"ID": id, "IDType": config.FHIRPatientIDType},
+			},
+		},
+	})
+	if outcome != nil {
+		return outcome, responseCode
 	}
 
-	return packageData.Timestamp, http.StatusOK
-}
+	if len(getRedoxList(response, "Patient", "Identifiers")) < 1 {
+		return newFHIROperationOutcome("not-found", "Patient/"+id+" not found"), http.StatusNotFound
+	}
 
-func getTimestampHandler(h HandlerArgs) (interface{}, int) {
-	return strconv.FormatInt(getTimestamp(), 10), http.StatusOK
+	patient := translateRedoxPatient(getRedoxField(response, "Patient"))
+	patient["id"] = id
+
+	return patient, http.StatusOK
 }
 
-func isAccountInGoodStanding(h HandlerArgs) (interface{}, int) {
-	userToken := sanitize(h.Vars["userToken"])
+func fhirReadPractitioner(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
 
-	appStoreReceipt, braintreeSubscriptionID, planTrialEnd, _ := getBraintreeSubscriptionID(userToken)
+	id := sanitize(h.Vars["id"])
 
-	/* Check trial against current timestamp if applicable */
+	response, outcome, responseCode := runFHIRRedoxQuery(h, "Provider", "ProviderQuery", map[string]interface{}{
+		"Providers": []interface{}{
+			map[string]interface{}{"ID": id, "IDType": config.FHIRPractitionerIDType},
+		},
+	})
+	if outcome != nil {
+		return outcome, responseCode
+	}
 
-	if planTrialEnd != 0 {
-		return planTrialEnd > getTimestamp(), http.StatusOK
+	for _, provider := range getRedoxList(response, "Providers") {
+		if practitioner := translateRedoxProvider(provider); practitioner["id"] == id {
+			return practitioner, http.StatusOK
+		}
 	}
 
-	/* Check App Store receipt, if applicable */
+	return newFHIROperationOutcome("not-found", "Practitioner/"+id+" not found"), http.StatusNotFound
+}
 
-	if appStoreReceipt != "" {
-		_, err := getAppStoreTransactionData(appStoreReceipt)
-		return err == nil, http.StatusOK
-	}
+func fhirSearchAppointments(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
 
-	/*
-		If no subscription ID, assume free or lifetime plan.
+	query := h.Request.URL.Query()
 
-		In error cases, err on the side of false negatives
-		rather than false positives.
-	*/
+	start := getTimestamp()
+	end := int64(0)
 
-	if braintreeSubscriptionID == "" {
-		return true, http.StatusOK
-	}
+	for _, date := range query["date"] {
+		timestamp, prefix, err := parseFHIRSearchDate(sanitize(date))
+		if err != nil {
+			return newFHIROperationOutcome("invalid", err.Error()), http.StatusBadRequest
+		}
 
-	bt := braintreeInit(h)
+		switch prefix {
+		case "ge", "gt":
+			start = timestamp
+		case "le", "lt":
+			end = timestamp
+		default:
+			start = timestamp
+			end = timestamp + 86400000
+		}
+	}
 
-	sub, err := bt.Subscription().Find(h.Context, braintreeSubscriptionID)
-	if err != nil {
-		return true, http.StatusOK
+	if end == 0 {
+		end = start + config.FHIRAppointmentSearchWindow
+	}
+	if end < start {
+		return newFHIROperationOutcome("invalid", "date range ends before it starts"), http.StatusBadRequest
 	}
 
-	if sub.Status == braintree.SubscriptionStatusActive || sub.Status == braintree.SubscriptionStatusPending {
-		return true, http.StatusOK
+	appointments, outcome, responseCode := searchFHIRAppointments(
+		h,
+		start,
+		end,
+		strings.TrimPrefix(sanitize(query.Get("patient")), "Patient/"),
+	)
+	if outcome != nil {
+		return outcome, responseCode
 	}
 
-	return false, http.StatusOK
+	return newFHIRBundle(appointments), http.StatusOK
 }
 
-func preAuth(h HandlerArgs) (interface{}, int) {
-	id := sanitize(h.Vars["id"])
+func fhirSearchPatients(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
 
-	if !isValidCyphID(id) {
-		return "invalid ID", http.StatusForbidden
+	query := h.Request.URL.Query()
+
+	sex := sanitize(query.Get("gender"))
+	if sex != "" {
+		sex = strings.ToUpper(sex[0:1]) + sex[1:]
 	}
 
-	customer, customerKey, err := getCustomer(h)
-	if err != nil {
+	identifiers := []interface{}{}
+	if identifier := sanitize(query.Get("identifier")); identifier != "" {
+		idType := config.FHIRPatientIDType
+		if i := strings.Index(identifier, "|"); i >= 0 {
+			idType = identifier[0:i]
+			identifier = identifier[i+1:]
+		}
+
+		identifiers = append(identifiers, map[string]interface{}{"ID": identifier, "IDType": idType})
+	}
+
+	patientQuery := compactFHIRElement(map[string]interface{}{
+		"Demographics": compactFHIRElement(map[string]interface{}{
+			"DOB":       sanitize(query.Get("birthdate")),
+			"FirstName": sanitize(query.Get("given")),
+			"LastName":  sanitize(query.Get("family")),
+			"Sex":       sex,
+		}),
+		"Identifiers": identifiers,
+	})
+
+	if len(patientQuery) < 1 {
+		return newFHIROperationOutcome("required", "at least one search parameter is required"), http.StatusBadRequest
+	}
+
+	response, outcome, responseCode := runFHIRRedoxQuery(h, "PatientSearch", "Query", map[string]interface{}{
+		"Patient": patientQuery,
+	})
+	if outcome != nil {
+		return outcome, responseCode
+	}
+
+	patients := []map[string]interface{}{}
+	if len(getRedoxList(response, "Patient", "Identifiers")) > 0 {
+		patients = append(patients, translateRedoxPatient(getRedoxField(response, "Patient")))
+	}
+
+	return newFHIRBundle(patients), http.StatusOK
+}
+
+func fhirSearchPractitioners(h HandlerArgs) (interface{}, int) {
+	h.Writer.Header().Set("Content-Type", "application/fhir+json")
+
+	query := h.Request.URL.Query()
+
+	providerQuery := compactFHIRElement(map[string]interface{}{
+		"FirstName": sanitize(query.Get("given")),
+		"LastName":  sanitize(query.Get("family")),
+	})
+
+	if identifier := sanitize(query.Get("identifier")); identifier != "" {
+		providerQuery["IDType"] = config.FHIRPractitionerIDType
+		if i := strings.Index(identifier, "|"); i >= 0 {
+			providerQuery["IDType"] = identifier[0:i]
+			identifier = identifier[i+1:]
+		}
+
+		providerQuery["ID"] = identifier
+	}
+
+	if len(providerQuery) < 1 {
+		return newFHIROperationOutcome("required", "at least one search parameter is required"), http.StatusBadRequest
+	}
+
+	response, outcome, responseCode := runFHIRRedoxQuery(h, "Provider", "ProviderQuery", map[string]interface{}{
+		"Providers": []interface{}{providerQuery},
+	})
+	if outcome != nil {
+		return outcome, responseCode
+	}
+
+	practitioners := []map[string]interface{}{}
+	for _, provider := range getRedoxList(response, "Providers") {
+		practitioners = append(practitioners, translateRedoxProvider(provider))
+	}
+
+	return newFHIRBundle(practitioners), http.StatusOK
+}
+
+func getContinent(h HandlerArgs) (interface{}, int) {
+	_, continentCode, _, _, _, _, _, _ := geolocate(h)
+	return continentCode, http.StatusOK
+}
+
+func getGeolocation(h HandlerArgs) (interface{}, int) {
+	// continent, continentCode, country, countryCode, city, postalCode, analID, firebaseRegion := geolocate(h)
+	_, _, _, countryCode, _, _, analID, firebaseRegion := geolocate(h)
+	// org := getOrg(h)
+
+	/* Return fields on an as-needed basis to avoid unnecessarily scaring users */
+	return map[string]string{
+		"analID": analID,
+		// "city":          city,
+		// "continent":     continent,
+		// "continentCode": continentCode,
+		// "country":       country,
+		"countryCode":    countryCode,
+		"firebaseRegion": firebaseRegion,
+		// "org":           org,
+		// "postalCode":    postalCode,
+	}, http.StatusOK
+}
+
+func getIceServers(h HandlerArgs) (interface{}, int) {
+	return getTwilioToken(h)["ice_servers"], http.StatusOK
+}
+
+func getIPFSGatewayStatuses(h HandlerArgs) (interface{}, int) {
+	statuses := []map[string]interface{}{}
+
+	gatewayURLs := getIPFSGatewayURLs()
+
+	for i := range gatewayURLs {
+		uptimeCheck, _ := getIPFSGatewayUptimeCheck(gatewayURLs[i].URL)
+		statuses = append(statuses, getIPFSGatewayStatus(gatewayURLs[i], uptimeCheck))
+	}
+
+	return statuses, http.StatusOK
+}
+
+func getPackage(h HandlerArgs) (interface{}, int) {
+	packageName := h.Request.URL.Path[9:]
+	packageData, ok := getActivePackage(h, packageName)
+
+	if !ok {
+		return "package not found", http.StatusBadRequest
+	}
+
+	isActive := true
+
+	if version := sanitize(h.Request.FormValue("version")); version != "" {
+		timestamp, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return "invalid version", http.StatusBadRequest
+		}
+
+		if timestamp != packageData.Timestamp {
+			packageData, err = getPackageVersion(h, packageName, timestamp)
+			if err != nil {
+				return "version not found", http.StatusNotFound
+			}
+
+			isActive = false
+		}
+	}
+
+	return map[string]interface{}{
+		"active":    isActive,
+		"gateways":  getIPFSGateways(geolocateCoordinates(h), packageData.Uptime),
+		"package":   packageData.Package,
+		"timestamp": packageData.Timestamp,
+		/* Lets clients check the signature themselves */
+		"verification": map[string]interface{}{
+			"keyID":     packageData.KeyID,
+			"publicKey": base64.StdEncoding.EncodeToString(packageSigningPublicKeys[packageData.KeyID]),
+			"signature": packageData.Signature,
+			"verified":  packageData.Verified,
+		},
+	}, http.StatusOK
+}
+
+func getPackageTimestamp(h HandlerArgs) (interface{}, int) {
+	packageName := h.Request.URL.Path[18:]
+	packageData, ok := getActivePackage(h, packageName)
+
+	if !ok {
+		return "package not found", http.StatusBadRequest
+	}
+
+	return packageData.Timestamp, http.StatusOK
+}
+
+func getPackageVersions(h HandlerArgs) (interface{}, int) {
+	packageName := h.Request.URL.Path[17:]
+	packageData, ok := getActivePackage(h, packageName)
+
+	if !ok {
+		return "package not found", http.StatusBadRequest
+	}
+
+	/* Key names sort by package name, then timestamp, so no composite index is needed */
+	packageVersions := []*PackageVersion{}
+	_, err := h.Datastore.GetAll(
+		h.Context,
+		datastoreQuery("PackageVersion").
+			Filter("__key__ >=", datastoreKey("PackageVersion", getPackageVersionKeyName(packageName, 0))).
+			Filter("__key__ <=", datastoreKey("PackageVersion", getPackageVersionKeyName(packageName, math.MaxInt64))),
+		&packageVersions,
+	)
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	versions := []map[string]interface{}{}
+	for _, packageVersion := range packageVersions {
+		versions = append(versions, map[string]interface{}{
+			"active":    packageVersion.Timestamp == packageData.Timestamp,
+			"ipfsHash":  packageVersion.IPFSHash,
+			"timestamp": packageVersion.Timestamp,
+		})
+	}
+
+	return versions, http.StatusOK
+}
+
+func getTimestampHandler(h HandlerArgs) (interface{}, int) {
+	return strconv.FormatInt(getTimestamp(), 10), http.StatusOK
+}
+
+func isAccountInGoodStanding(h HandlerArgs) (interface{}, int) {
+	userToken := sanitize(h.Vars["userToken"])
+
+	appStoreReceipt, braintreeSubscriptionID, planTrialEnd, _ := getBraintreeSubscriptionID(userToken)
+
+	/* Check trial against current timestamp if applicable */
+
+	if planTrialEnd != 0 {
+		return planTrialEnd > getTimestamp(), http.StatusOK
+	}
+
+	/* Check App Store receipt, if applicable */
+
+	if appStoreReceipt != "" {
+		_, err := getAppStoreTransactionData(appStoreReceipt)
+		return err == nil, http.StatusOK
+	}
+
+	/*
+		If no subscription ID, assume free or lifetime plan.
+
+		In error cases, err on the side of false negatives
+		rather than false positives.
+	*/
+
+	if braintreeSubscriptionID == "" {
+		return true, http.StatusOK
+	}
+
+	bt := braintreeInit(h)
+
+	sub, err := bt.Subscription().Find(h.Context, braintreeSubscriptionID)
+	if err != nil {
+		return true, http.StatusOK
+	}
+
+	if sub.Status == braintree.SubscriptionStatusActive || sub.Status == braintree.SubscriptionStatusPending {
+		return true, http.StatusOK
+	}
+
+	return false, http.StatusOK
+}
+
+func preAuth(h HandlerArgs) (interface{}, int) {
+	id := sanitize(h.Vars["id"])
+
+	if !isValidCyphID(id) {
+		return "invalid ID", http.StatusForbidden
+	}
+
+	customer, customerKey, err := getCustomer(h)
+	if err != nil {
 		return err.Error(), http.StatusNotFound
 	}
 
-	proFeatures, sessionCountLimit, err := getPlanData(h, customer)
+	proFeatures, sessionCountLimit, preAuthorizationLifetime, preAuthorizationUses, err := getPlanData(h, customer)
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
@@ -969,6 +1593,8 @@ func preAuth(h HandlerArgs) (interface{}, int) {
 			customer,
 			&PreAuthorizedCyph{
 				ID:          id,
+				Lifetime:    preAuthorizationLifetime,
+				MaxUses:     preAuthorizationUses,
 				ProFeatures: proFeaturesJSON,
 				Timestamp:   customer.LastSession,
 			},
@@ -990,7 +1616,7 @@ func proUnlock(h HandlerArgs) (interface{}, int) {
 		return err.Error(), http.StatusNotFound
 	}
 
-	_, _, err = getPlanData(h, customer)
+	_, _, _, _, err = getPlanData(h, customer)
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
@@ -1022,16 +1648,17 @@ func redoxAddCredentials(h HandlerArgs) (interface{}, int) {
 		return err.Error(), http.StatusInternalServerError
 	}
 
-	_, err = h.Datastore.Put(
-		h.Context,
-		redoxCredentialsKey,
-		&RedoxCredentials{
-			APIKey:      masterAPIKey,
-			RedoxAPIKey: redoxAPIKey,
-			RedoxSecret: redoxSecret,
-			Username:    username,
-		},
-	)
+	redoxCredentials, err := encryptRedoxCredentials(&RedoxCredentials{
+		APIKey:      masterAPIKey,
+		RedoxAPIKey: redoxAPIKey,
+		RedoxSecret: redoxSecret,
+		Username:    username,
+	})
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	_, err = h.Datastore.Put(h.Context, redoxCredentialsKey, redoxCredentials)
 
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
@@ -1054,7 +1681,10 @@ func redoxDeleteAPIKey(h HandlerArgs) (interface{}, int) {
 		return "invalid master API key", http.StatusForbidden
 	}
 
-	if err := h.Datastore.Delete(h.Context, redoxCredentialsKey); err != nil {
+	if err := h.Datastore.DeleteMulti(
+		h.Context,
+		[]*datastore.Key{redoxCredentialsKey, datastoreKey("RedoxUsage", apiKey)},
+	); err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
 
@@ -1064,21 +1694,31 @@ func redoxDeleteAPIKey(h HandlerArgs) (interface{}, int) {
 func redoxGenerateAPIKey(h HandlerArgs) (interface{}, int) {
 	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
 	username := sanitize(h.Request.PostFormValue("username"))
+	label := sanitize(h.Request.PostFormValue("label"))
+	allowedDataModels := parseRedoxDataModels(sanitize(h.Request.PostFormValue("allowedDataModels")))
+
+	if _, err := getRedoxMasterCredentials(h, masterAPIKey); err != nil {
+		return err.Error(), http.StatusForbidden
+	}
 
 	apiKey, redoxCredentialsKey, err := generateAPIKey(h, "RedoxCredentials")
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
 
-	_, err = h.Datastore.Put(
-		h.Context,
-		redoxCredentialsKey,
-		&RedoxCredentials{
-			APIKey:       apiKey,
-			MasterAPIKey: masterAPIKey,
-			Username:     username,
-		},
-	)
+	redoxCredentials := &RedoxCredentials{
+		APIKey:            apiKey,
+		AllowedDataModels: allowedDataModels,
+		Label:             label,
+		MasterAPIKey:      masterAPIKey,
+		Username:          username,
+	}
+
+	if err := setRedoxLimits(h, redoxCredentials); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	_, err = h.Datastore.Put(h.Context, redoxCredentialsKey, redoxCredentials)
 
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
@@ -1087,208 +1727,594 @@ func redoxGenerateAPIKey(h HandlerArgs) (interface{}, int) {
 	return apiKey, http.StatusOK
 }
 
-func redoxVerifyAPIKey(h HandlerArgs) (interface{}, int) {
-	apiKeyOrMasterAPIKey := sanitize(h.Request.PostFormValue("apiKeyOrMasterAPIKey"))
+func redoxGetUsage(h HandlerArgs) (interface{}, int) {
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
 
-	redoxCredentials := &RedoxCredentials{}
+	masterCredentials, err := getRedoxMasterCredentials(h, masterAPIKey)
+	if err != nil {
+		return err.Error(), http.StatusForbidden
+	}
 
-	err := h.Datastore.Get(
+	redoxCredentialsList := []*RedoxCredentials{masterCredentials}
+
+	it := h.Datastore.Run(
 		h.Context,
-		datastore.NameKey(
-			"RedoxCredentials",
-			apiKeyOrMasterAPIKey,
-			nil,
-		),
-		redoxCredentials,
+		datastoreQuery("RedoxCredentials").Filter("MasterAPIKey =", masterAPIKey),
 	)
 
+	for {
+		redoxCredentials := &RedoxCredentials{}
+		_, err := it.Next(redoxCredentials)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err.Error(), http.StatusInternalServerError
+		}
+
+		redoxCredentialsList = append(redoxCredentialsList, redoxCredentials)
+	}
+
+	/* Daily counts are summed across usage shards when reported */
+	keys := []*datastore.Key{}
+	shardCounts := []int{}
+	for _, redoxCredentials := range redoxCredentialsList {
+		usageKeys := getRedoxUsageKeys(redoxCredentials)
+		keys = append(keys, usageKeys...)
+		shardCounts = append(shardCounts, len(usageKeys))
+	}
+
+	usages, err := getRedoxUsageShards(h, keys)
 	if err != nil {
-		return `{"isMaster": false, "isValid": false}`, http.StatusOK
-	} else if redoxCredentials.MasterAPIKey != "" {
-		return `{"isMaster": false, "isValid": true}`, http.StatusOK
-	} else {
-		return `{"isMaster": true, "isValid": true}`, http.StatusOK
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	redoxUsages := []map[string]interface{}{}
+	for i, redoxCredentials := range redoxCredentialsList {
+		redoxUsages = append(redoxUsages, getRedoxUsage(redoxCredentials, usages[:shardCounts[i]]))
+		usages = usages[shardCounts[i]:]
 	}
+
+	return map[string]interface{}{
+		"apiKeys": redoxUsages[1:],
+		"master":  redoxUsages[0],
+	}, http.StatusOK
 }
 
-func redoxRunCommand(h HandlerArgs) (interface{}, int) {
-	/* Get Redox API credentials */
+func redoxListAPIKeys(h HandlerArgs) (interface{}, int) {
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
 
-	apiKeyOrMasterAPIKey := sanitize(h.Request.PostFormValue("apiKeyOrMasterAPIKey"))
-	redoxCommand := h.Request.PostFormValue("redoxCommand")
-	timestamp := getTimestamp()
+	if _, err := getRedoxMasterCredentials(h, masterAPIKey); err != nil {
+		return err.Error(), http.StatusForbidden
+	}
 
-	redoxCredentials := &RedoxCredentials{}
+	apiKeys := []map[string]interface{}{}
 
-	err := h.Datastore.Get(
+	it := h.Datastore.Run(
 		h.Context,
-		datastore.NameKey(
-			"RedoxCredentials",
-			apiKeyOrMasterAPIKey,
-			nil,
-		),
-		redoxCredentials,
+		datastoreQuery("RedoxCredentials").Filter("MasterAPIKey =", masterAPIKey),
 	)
 
-	if err != nil {
+	for {
+		redoxCredentials := &RedoxCredentials{}
+		_, err := it.Next(redoxCredentials)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err.Error(), http.StatusInternalServerError
+		}
+
+		allowedDataModels := redoxCredentials.AllowedDataModels
+		if allowedDataModels == nil {
+			allowedDataModels = []string{}
+		}
+
+		apiKeys = append(apiKeys, map[string]interface{}{
+			"allowedDataModels": allowedDataModels,
+			"apiKey":            redoxCredentials.APIKey,
+			"disabled":          redoxCredentials.Disabled,
+			"label":             redoxCredentials.Label,
+			"username":          redoxCredentials.Username,
+		})
+	}
+
+	return apiKeys, http.StatusOK
+}
+
+func redoxListEvents(h HandlerArgs) (interface{}, int) {
+	apiKeyOrMasterAPIKey := sanitize(h.Request.PostFormValue("apiKeyOrMasterAPIKey"))
+
+	redoxCredentials := &RedoxCredentials{}
+	if err := h.Datastore.Get(h.Context, datastoreKey("RedoxCredentials", apiKeyOrMasterAPIKey), redoxCredentials); err != nil {
 		return "invalid API key", http.StatusNotFound
 	}
 
-	username := redoxCredentials.Username
+	if redoxCredentials.Disabled {
+		return "disabled API key", http.StatusForbidden
+	}
+
+	masterAPIKey := redoxCredentials.MasterAPIKey
+	if masterAPIKey == "" {
+		masterAPIKey = apiKeyOrMasterAPIKey
+	}
+
+	start, err := strconv.ParseInt(sanitize(h.Request.PostFormValue("start")), 10, 64)
+	if err != nil {
+		start = 0
+	}
 
-	if redoxCredentials.RedoxAPIKey == "" || redoxCredentials.RedoxSecret == "" {
-		if redoxCredentials.MasterAPIKey == "" {
-			return "retired API key", http.StatusNotFound
+	limit, err := strconv.Atoi(sanitize(h.Request.PostFormValue("limit")))
+	if err != nil || limit < 1 || limit > config.RedoxRequestLogPageSize {
+		limit = config.RedoxRequestLogPageSize
+	}
+
+	query := datastoreQuery("RedoxEvent").
+		Filter("__key__ >=", datastoreKey("RedoxEvent", getRedoxEventKeyName(masterAPIKey, start))).
+		Filter("__key__ <", datastoreKey("RedoxEvent", getRedoxEventKeyName(masterAPIKey, getTimestamp()+1))).
+		Limit(limit)
+
+	if cursorString := sanitize(h.Request.PostFormValue("cursor")); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			return "invalid cursor", http.StatusBadRequest
 		}
 
-		err := h.Datastore.Get(
-			h.Context,
-			datastore.NameKey(
-				"RedoxCredentials",
-				redoxCredentials.MasterAPIKey,
-				nil,
-			),
-			redoxCredentials,
-		)
+		query = query.Start(cursor)
+	}
+
+	count := 0
+	events := []map[string]interface{}{}
+	it := h.Datastore.Run(h.Context, query)
 
+	for {
+		redoxEvent := &RedoxEvent{}
+		key, err := it.Next(redoxEvent)
+		if err == iterator.Done {
+			break
+		}
 		if err != nil {
 			return err.Error(), http.StatusInternalServerError
 		}
 
-		if redoxCredentials.RedoxAPIKey == "" || redoxCredentials.RedoxSecret == "" {
-			return "redox credentials not found", http.StatusInternalServerError
+		count++
+
+		/* Child keys only see the data models they're allowed to query */
+		if !isRedoxDataModelAllowed(redoxCredentials, redoxEvent.DataModel) {
+			continue
+		}
+
+		if err := decryptRedoxEvent(redoxEvent); err != nil {
+			return err.Error(), http.StatusInternalServerError
+		}
+
+		events = append(events, map[string]interface{}{
+			"dataModel": redoxEvent.DataModel,
+			"eventType": redoxEvent.EventType,
+			"id":        getRedoxEventID(masterAPIKey, key.Name),
+			"payload":   json.RawMessage(redoxEvent.Payload),
+			"timestamp": redoxEvent.Timestamp,
+		})
+	}
+
+	nextCursor := ""
+	if count == limit {
+		if cursor, err := it.Cursor(); err == nil {
+			nextCursor = cursor.String()
 		}
 	}
 
-	/* Get Redox API auth token */
+	return map[string]interface{}{
+		"cursor": nextCursor,
+		"events": events,
+	}, http.StatusOK
+}
 
-	redoxAuth := &RedoxAuth{}
-	redoxAuthKey := datastoreKey("RedoxAuth", redoxCredentials.RedoxAPIKey)
+func redoxListRequestLogs(h HandlerArgs) (interface{}, int) {
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
+	username := sanitize(h.Request.PostFormValue("username"))
 
-	err = h.Datastore.Get(h.Context, redoxAuthKey, redoxAuth)
+	if _, err := getRedoxMasterCredentials(h, masterAPIKey); err != nil {
+		return err.Error(), http.StatusForbidden
+	}
 
-	if err != nil || redoxAuth.AccessToken == "" || redoxAuth.Expires < (timestamp+3600000) {
-		var req *http.Request
+	if username == "" {
+		return "username required", http.StatusBadRequest
+	}
 
-		if redoxAuth.RefreshToken == "" {
-			req, err = http.NewRequest(
-				methods.POST,
-				"https://api.redoxengine.com/auth/authenticate",
-				bytes.NewBuffer([]byte(
-					`{"apiKey": "`+
-						redoxCredentials.RedoxAPIKey+
-						`", "secret": "`+
-						redoxCredentials.RedoxSecret+
-						`"}`,
-				)),
-			)
-		} else {
-			req, err = http.NewRequest(
-				methods.POST,
-				"https://api.redoxengine.com/auth/refreshToken",
-				bytes.NewBuffer([]byte(
-					`{"apiKey": "`+
-						redoxCredentials.RedoxAPIKey+
-						`", "refreshToken": "`+
-						redoxAuth.RefreshToken+
-						`"}`,
-				)),
-			)
-		}
+	start, err := strconv.ParseInt(sanitize(h.Request.PostFormValue("start")), 10, 64)
+	if err != nil {
+		start = 0
+	}
+
+	end, err := strconv.ParseInt(sanitize(h.Request.PostFormValue("end")), 10, 64)
+	if err != nil {
+		end = getTimestamp() + 1
+	}
 
+	limit, err := strconv.Atoi(sanitize(h.Request.PostFormValue("limit")))
+	if err != nil || limit < 1 || limit > config.RedoxRequestLogPageSize {
+		limit = config.RedoxRequestLogPageSize
+	}
+
+	/* Key names sort by master API key, username, then timestamp, so no composite index is needed */
+	query := datastoreQuery("RedoxRequestLog").
+		Filter("__key__ >=", datastoreKey("RedoxRequestLog", getRedoxRequestLogKeyName(masterAPIKey, username, start))).
+		Filter("__key__ <", datastoreKey("RedoxRequestLog", getRedoxRequestLogKeyName(masterAPIKey, username, end))).
+		Limit(limit)
+
+	if cursorString := sanitize(h.Request.PostFormValue("cursor")); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
 		if err != nil {
-			return err.Error(), http.StatusInternalServerError
+			return "invalid cursor", http.StatusBadRequest
 		}
 
-		req.Header.Add("Content-type", "application/json")
+		query = query.Start(cursor)
+	}
+
+	logs := []*RedoxRequestLog{}
+	it := h.Datastore.Run(h.Context, query)
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	for {
+		redoxRequestLog := &RedoxRequestLog{}
+		_, err := it.Next(redoxRequestLog)
+		if err == iterator.Done {
+			break
+		}
 		if err != nil {
 			return err.Error(), http.StatusInternalServerError
 		}
 
-		jsonBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err.Error(), http.StatusInternalServerError
+		logs = append(logs, redoxRequestLog)
+	}
+
+	nextCursor := ""
+	if len(logs) == limit {
+		if cursor, err := it.Cursor(); err == nil {
+			nextCursor = cursor.String()
 		}
+	}
+
+	return map[string]interface{}{
+		"cursor": nextCursor,
+		"logs":   logs,
+	}, http.StatusOK
+}
+
+/* Destination endpoint for Redox; the verification token is set on the destination in the Redox dashboard */
+func redoxReceiveWebhook(h HandlerArgs) (interface{}, int) {
+	id := sanitize(h.Vars["id"])
+
+	redoxWebhook := &RedoxWebhook{}
+	if err := h.Datastore.Get(h.Context, datastoreKey("RedoxWebhook", id), redoxWebhook); err != nil {
+		return "webhook not found", http.StatusNotFound
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(h.Writer, h.Request.Body, config.RedoxWebhookMaxBodySize))
+	if err != nil {
+		return "request too large", http.StatusRequestEntityTooLarge
+	}
+
+	var redoxEvent map[string]interface{}
+	if err := json.Unmarshal(body, &redoxEvent); err != nil {
+		return "invalid JSON", http.StatusBadRequest
+	}
+
+	/* Redox sends the token in the body when verifying a new destination, and as a header thereafter */
+	verificationToken := h.Request.Header.Get("verification-token")
+	if verificationToken == "" {
+		verificationToken = getRedoxString(redoxEvent, "verification-token")
+	}
+
+	if subtle.ConstantTimeCompare(
+		[]byte(hashRedoxVerificationToken(verificationToken)),
+		[]byte(redoxWebhook.VerificationTokenHash),
+	) != 1 {
+		return "invalid verification token", http.StatusUnauthorized
+	}
+
+	if challenge := getRedoxString(redoxEvent, "challenge"); challenge != "" {
+		return challenge, http.StatusOK
+	}
+
+	dataModel, eventType := getRedoxCommandMetadata(string(body))
+
+	/* Acknowledge events we don't store so that Redox doesn't retry them */
+	if _, ok := config.RedoxWebhookEvents[dataModel][eventType]; !ok {
+		return "", http.StatusOK
+	}
+
+	timestamp := getTimestamp()
+
+	encryptedRedoxEvent, err := encryptRedoxEvent(&RedoxEvent{
+		DataModel:    dataModel,
+		EventType:    eventType,
+		MasterAPIKey: redoxWebhook.MasterAPIKey,
+		Payload:      string(body),
+		Timestamp:    timestamp,
+	})
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	if _, err := h.Datastore.Put(
+		h.Context,
+		datastoreKey(
+			"RedoxEvent",
+			getRedoxEventKeyName(redoxWebhook.MasterAPIKey, timestamp)+generateRandomID(),
+		),
+		encryptedRedoxEvent,
+	); err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	return "", http.StatusOK
+}
+
+func redoxReencrypt(h HandlerArgs) (interface{}, int) {
+	if sanitize(h.Request.PostFormValue("cyphAdminKey")) != cyphAdminKey {
+		return "", http.StatusForbidden
+	}
+
+	/*
+		Re-encrypts legacy plaintext rows and rows wrapped with a rotated-out key.
+		Each call stops at a deadline; until a call reports done, pass its cursor back in.
+		Rows under older keys stay readable in the meantime.
+	*/
+
+	deadline := time.Now().Add(config.ExpiredEntityCleanupTimeout)
+	counts := map[string]int{}
+
+	kindIndex := 0
+	cursorString := ""
+
+	if cursorData := strings.SplitN(sanitize(h.Request.PostFormValue("cursor")), ":", 2); len(cursorData) == 2 {
+		for i, kind := range redoxReencryptKinds {
+			if kind == cursorData[0] {
+				kindIndex = i
+				cursorString = cursorData[1]
+			}
+		}
+	}
+
+	for i := kindIndex; i < len(redoxReencryptKinds); i++ {
+		kind := redoxReencryptKinds[i]
+
+		count, nextCursor, done, err := reencryptRedoxEntities(h, kind, cursorString, deadline)
+		counts[kind] = count
 
-		var body map[string]interface{}
-		err = json.Unmarshal(jsonBody, &body)
 		if err != nil {
+			log.Printf("Failed to re-encrypt %s in redoxReencrypt: %v", kind, err)
 			return err.Error(), http.StatusInternalServerError
 		}
 
-		accessTokenDynamic, _ := body["accessToken"]
-		switch accessToken := accessTokenDynamic.(type) {
-		case string:
-			redoxAuth.AccessToken = accessToken
-		default:
-			return "invalid Redox auth data", http.StatusInternalServerError
+		if !done {
+			return map[string]interface{}{
+				"counts": counts,
+				"cursor": kind + ":" + nextCursor,
+				"done":   false,
+			}, http.StatusOK
 		}
 
-		expiresDynamic, _ := body["expires"]
-		switch expires := expiresDynamic.(type) {
-		case string:
-			expiryTimestamp, _ := time.Parse(time.RFC3339, expires)
-			redoxAuth.Expires = expiryTimestamp.UnixNano() / 1e6
-		default:
-			return "invalid Redox auth data", http.StatusInternalServerError
-		}
+		cursorString = ""
+	}
 
-		refreshTokenDynamic, _ := body["refreshToken"]
-		switch refreshToken := refreshTokenDynamic.(type) {
-		case string:
-			redoxAuth.RefreshToken = refreshToken
-		default:
-			return "invalid Redox auth data", http.StatusInternalServerError
-		}
+	return map[string]interface{}{
+		"counts": counts,
+		"done":   true,
+	}, http.StatusOK
+}
 
-		redoxAuth.RedoxAPIKey = redoxCredentials.RedoxAPIKey
+func redoxRunCommand(h HandlerArgs) (interface{}, int) {
+	return runRedoxCommand(
+		h,
+		sanitize(h.Request.PostFormValue("apiKeyOrMasterAPIKey")),
+		h.Request.PostFormValue("redoxCommand"),
+	)
+}
 
-		h.Datastore.Put(h.Context, redoxAuthKey, redoxAuth)
+/* Limits on master keys are set by us rather than by the key holder */
+func redoxSetLimits(h HandlerArgs) (interface{}, int) {
+	if sanitize(h.Request.PostFormValue("cyphAdminKey")) != cyphAdminKey {
+		return "", http.StatusForbidden
 	}
 
-	/* Make and log request */
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
 
-	req, err := http.NewRequest(
-		methods.POST,
-		"https://api.redoxengine.com/query",
-		bytes.NewBuffer([]byte(redoxCommand)),
-	)
+	masterCredentials, err := getRedoxMasterCredentials(h, masterAPIKey)
+	if err != nil {
+		return err.Error(), http.StatusNotFound
+	}
 
+	if err := setRedoxLimits(h, masterCredentials); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	if _, err := h.Datastore.Put(h.Context, datastoreKey("RedoxCredentials", masterAPIKey), masterCredentials); err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	return "", http.StatusOK
+}
+
+/* Registers or rotates the Redox destination of a master API key; the token is only shown once */
+func redoxSetUpWebhook(h HandlerArgs) (interface{}, int) {
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
+
+	if _, err := getRedoxMasterCredentials(h, masterAPIKey); err != nil {
+		return err.Error(), http.StatusForbidden
+	}
+
+	webhookKeys, err := h.Datastore.GetAll(
+		h.Context,
+		datastoreQuery("RedoxWebhook").Filter("MasterAPIKey =", masterAPIKey).KeysOnly(),
+		nil,
+	)
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
 
-	req.Header.Add("Authorization", "Bearer "+redoxAuth.AccessToken)
-	req.Header.Add("Content-type", "application/json")
+	var webhookKey *datastore.Key
+	if len(webhookKeys) > 0 {
+		webhookKey = webhookKeys[0]
+	} else if _, webhookKey, err = generateAPIKey(h, "RedoxWebhook"); err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	verificationToken := generateRandomID()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if _, err := h.Datastore.Put(h.Context, webhookKey, &RedoxWebhook{
+		MasterAPIKey:          masterAPIKey,
+		VerificationTokenHash: hashRedoxVerificationToken(verificationToken),
+	}); err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	return map[string]string{
+		"url":               config.RootURL + "/redox/webhook/" + webhookKey.Name,
+		"verificationToken": verificationToken,
+	}, http.StatusOK
+}
+
+/* Only fields present in the request are changed */
+func redoxUpdateAPIKey(h HandlerArgs) (interface{}, int) {
+	apiKey := sanitize(h.Request.PostFormValue("apiKey"))
+	masterAPIKey := sanitize(h.Request.PostFormValue("masterAPIKey"))
+
+	if _, err := getRedoxMasterCredentials(h, masterAPIKey); err != nil {
+		return err.Error(), http.StatusForbidden
+	}
+
+	redoxCredentials, redoxCredentialsKey, err := getRedoxChildCredentials(h, masterAPIKey, apiKey)
 	if err != nil {
+		return err.Error(), http.StatusNotFound
+	}
+
+	if _, ok := h.Request.PostForm["allowedDataModels"]; ok {
+		redoxCredentials.AllowedDataModels = parseRedoxDataModels(
+			sanitize(h.Request.PostFormValue("allowedDataModels")),
+		)
+	}
+
+	if _, ok := h.Request.PostForm["disabled"]; ok {
+		disabled, err := strconv.ParseBool(sanitize(h.Request.PostFormValue("disabled")))
+		if err != nil {
+			return "invalid disabled value", http.StatusBadRequest
+		}
+
+		redoxCredentials.Disabled = disabled
+	}
+
+	if _, ok := h.Request.PostForm["label"]; ok {
+		redoxCredentials.Label = sanitize(h.Request.PostFormValue("label"))
+	}
+
+	if err := setRedoxLimits(h, redoxCredentials); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	if _, err := h.Datastore.Put(h.Context, redoxCredentialsKey, redoxCredentials); err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	return "", http.StatusOK
+}
+
+func redoxVerifyAPIKey(h HandlerArgs) (interface{}, int) {
+	apiKeyOrMasterAPIKey := sanitize(h.Request.PostFormValue("apiKeyOrMasterAPIKey"))
+
+	redoxCredentials := &RedoxCredentials{}
+
+	err := h.Datastore.Get(
+		h.Context,
+		datastoreKey("RedoxCredentials", apiKeyOrMasterAPIKey),
+		redoxCredentials,
+	)
+
+	if err != nil {
+		return `{"isMaster": false, "isValid": false}`, http.StatusOK
+	} else if redoxCredentials.Disabled {
+		return `{"disabled": true, "isMaster": false, "isValid": false}`, http.StatusOK
+	} else if redoxCredentials.MasterAPIKey != "" {
+		return `{"isMaster": false, "isValid": true}`, http.StatusOK
+	} else {
+		return `{"isMaster": true, "isValid": true}`, http.StatusOK
+	}
+}
+
+/* Publishes posted packages and gateways (by default, the deployed files) to every instance */
+func reloadPackages(h HandlerArgs) (interface{}, int) {
+	if sanitize(h.Request.PostFormValue("cyphAdminKey")) != cyphAdminKey {
+		return "", http.StatusForbidden
+	}
+
+	packagesJSON, ipfsGatewaysJSON, err := readDeployedPackageDatabase()
 	if err != nil {
 		return err.Error(), http.StatusInternalServerError
 	}
 
-	responseBody := string(responseBodyBytes)
+	if packages := h.Request.PostFormValue("packages"); packages != "" {
+		packagesJSON = []byte(packages)
+	}
+	if ipfsGateways := h.Request.PostFormValue("ipfsGateways"); ipfsGateways != "" {
+		ipfsGatewaysJSON = []byte(ipfsGateways)
+	}
 
-	h.Datastore.Put(
+	if err := publishPackageDatabase(h, packagesJSON, ipfsGatewaysJSON); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	return map[string]interface{}{
+		"gateways": len(getIPFSGatewayURLs()),
+		"packages": getPackageNames(),
+		"refused":  getRefusedPackages(),
+	}, http.StatusOK
+}
+
+/* A timestamp of 0 reactivates the latest version */
+func rollBackPackage(h HandlerArgs) (interface{}, int) {
+	if sanitize(h.Request.PostFormValue("cyphAdminKey")) != cyphAdminKey {
+		return "", http.StatusForbidden
+	}
+
+	packageName := sanitize(h.Request.PostFormValue("package"))
+	latest, ok := getPackageData(packageName)
+
+	if !ok {
+		return "package not found", http.StatusNotFound
+	}
+
+	timestamp, err := strconv.ParseInt(sanitize(h.Request.PostFormValue("timestamp")), 10, 64)
+	if err != nil || timestamp < 0 {
+		return "invalid timestamp", http.StatusBadRequest
+	}
+
+	packageData := latest
+	if timestamp != 0 {
+		packageData, err = getPackageVersion(h, packageName, timestamp)
+		if err == datastore.ErrNoSuchEntity {
+			return "version not found", http.StatusNotFound
+		}
+		if err != nil {
+			return err.Error(), http.StatusBadRequest
+		}
+	}
+
+	_, err = h.Datastore.Put(
 		h.Context,
-		datastoreKey("RedoxRequestLog", ""),
-		&RedoxRequestLog{
-			RedoxCommand: sanitize(redoxCommand),
-			Response:     sanitize(responseBody),
-			Timestamp:    timestamp,
-			Username:     username,
-		},
+		datastoreKey("PackageActiveVersion", packageName),
+		&PackageActiveVersion{Timestamp: timestamp},
 	)
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	setActivePackage(packageName, packageData)
 
-	return responseBody, http.StatusOK
+	return map[string]interface{}{
+		"package":   packageName,
+		"timestamp": packageData.Timestamp,
+	}, http.StatusOK
 }
 
 func rollOutWaitlistInvites(h HandlerArgs) (interface{}, int) {
@@ -23,9 +23,14 @@ type BetaSignup struct {
 
 // BurnerChannel : Burner channel
 type BurnerChannel struct {
-	ChannelID string
-	ID        string
-	Timestamp int64
+	ChannelID       string
+	ID              string
+	JoinTimestamp   int64
+	JoinTimestamps  []int64 `datastore:",noindex"`
+	Lifetime        int64   `datastore:",noindex"`
+	MaxParticipants int64
+	OwnerKeyHash    string `datastore:",noindex"`
+	Timestamp       int64
 }
 
 // Customer : Customer with API key
@@ -49,16 +54,51 @@ type CustomerEmail struct {
 	Email  string
 }
 
+// IPFSGatewayContentCheckData : Data on whether a gateway serves a package's content
+type IPFSGatewayContentCheckData struct {
+	LastError string
+	Result    bool
+	Timestamp int64
+}
+
+// GeoLocation : Approximate location of a client
+type GeoLocation struct {
+	ContinentCode  string
+	CountryCode    string
+	HasCoordinates bool
+	Latitude       float64
+	Longitude      float64
+}
+
 // IPFSGatewayData : Data on an IPFS gateway
 type IPFSGatewayData struct {
-	ContinentCode string
-	URL           string
+	ContinentCode  string
+	CountryCode    string
+	HasCoordinates bool `json:"-"`
+	Latitude       float64
+	Longitude      float64
+	URL            string
+}
+
+// IPFSGatewayHealth : Gateway health shared between instances, probed by one lease holder at a time
+type IPFSGatewayHealth struct {
+	Content      []byte                     `datastore:",noindex"`
+	LeaseExpires int64                      `datastore:",noindex"`
+	LeaseHolder  string                     `datastore:",noindex"`
+	UptimeCheck  IPFSGatewayUptimeCheckData `datastore:",noindex"`
 }
 
 // IPFSGatewayUptimeCheckData : Data on whether a gateway is working
 type IPFSGatewayUptimeCheckData struct {
-	Result    bool
-	Timestamp int64
+	CircuitOpenUntil    int64
+	ConsecutiveFailures int
+	Drained             bool
+	ErrorRate           float64
+	LastError           string
+	Latency             float64
+	Result              bool
+	Throughput          float64
+	Timestamp           int64
 }
 
 // IPFSGatewayUptimeData : Data used to check whether a gateway is working
@@ -67,105 +107,233 @@ type IPFSGatewayUptimeData struct {
 	IPFSHash      string
 }
 
+// PackageActiveVersion : Version of a package that an admin rolled back to
+type PackageActiveVersion struct {
+	Timestamp int64
+}
+
 // PackageData : Data for an application package
 type PackageData struct {
+	KeyID     string
 	Package   interface{}
+	Signature string
 	Timestamp int64
 	Uptime    IPFSGatewayUptimeData
+	Verified  bool `json:"-"`
+}
+
+// PackageDatabase : Package database published to every instance; JSON is gzipped to fit within entity size limits
+type PackageDatabase struct {
+	IPFSGateways      []byte `datastore:",noindex"`
+	Packages          []byte `datastore:",noindex"`
+	PackagesTimestamp int64  `datastore:",noindex"`
+	Timestamp         int64  `datastore:",noindex"`
+}
+
+// PackageVersion : Previously served version of a package
+type PackageVersion struct {
+	IntegrityHash string `datastore:",noindex"`
+	IPFSHash      string `datastore:",noindex"`
+	KeyID         string `datastore:",noindex"`
+	Name          string
+	Package       []byte `datastore:",noindex"`
+	Signature     string `datastore:",noindex"`
+	Timestamp     int64
 }
 
 // Plan : Braintree plan
 type Plan struct {
-	AccountsPlan      string
-	GiftPack          bool
-	Price             int64
-	ProFeatures       map[string]bool
-	SessionCountLimit int64
+	AccountsPlan             string
+	GiftPack                 bool
+	PreAuthorizationLifetime int64
+	PreAuthorizationUses     int64
+	Price                    int64
+	ProFeatures              map[string]bool
+	SessionCountLimit        int64
 }
 
 // PreAuthorizedCyph : Representation of an approved usage of the API
 type PreAuthorizedCyph struct {
 	ID          string
+	Lifetime    int64
+	MaxUses     int64
 	ProFeatures []byte
 	Timestamp   int64
+	UseCount    int64
 }
 
 // RedoxAuth : Current Redox auth data
 type RedoxAuth struct {
-	AccessToken  string
-	Expires      int64
-	RefreshToken string
-	RedoxAPIKey  string
+	AccessToken        string `datastore:",noindex"`
+	EncryptedDataKey   []byte `datastore:",noindex"`
+	Expires            int64
+	KeyEncryptionKeyID string
+	RefreshToken       string `datastore:",noindex"`
+	RedoxAPIKey        string
+}
+
+// RedoxAuthRefresh : In-flight Redox auth refresh shared by concurrent requests
+type RedoxAuthRefresh struct {
+	Auth  *RedoxAuth
+	Done  chan struct{}
+	Error error
 }
 
 // RedoxCredentials : Redox credentials
 type RedoxCredentials struct {
-	APIKey       string
-	MasterAPIKey string
-	RedoxAPIKey  string
-	RedoxSecret  string
-	Username     string
+	APIKey             string
+	AllowedDataModels  []string `datastore:",noindex"`
+	DailyQuota         int64    `datastore:",noindex"`
+	Disabled           bool
+	EncryptedDataKey   []byte `datastore:",noindex"`
+	KeyEncryptionKeyID string
+	Label              string `datastore:",noindex"`
+	MasterAPIKey       string
+	RateLimit          int64 `datastore:",noindex"`
+	RateLimitBurst     int64 `datastore:",noindex"`
+	RedoxAPIKey        string
+	RedoxSecret        string `datastore:",noindex"`
+	Username           string
+}
+
+// RedoxEvent : Inbound Redox event received through a webhook
+type RedoxEvent struct {
+	DataModel          string
+	EncryptedDataKey   []byte `datastore:",noindex"`
+	EventType          string
+	KeyEncryptionKeyID string
+	MasterAPIKey       string
+	Payload            string `datastore:",noindex"`
+	Timestamp          int64
+}
+
+// RedoxKeyEncryptionKeys : Keys used to wrap per-record Redox data keys
+type RedoxKeyEncryptionKeys struct {
+	CurrentID string
+	Keys      map[string][]byte
 }
 
 // RedoxRequestLog : Log of a Redox request
 type RedoxRequestLog struct {
-	RedoxCommand string
-	Response     string
+	DataModel    string
+	EventType    string
+	Latency      int64
+	MasterAPIKey string
+	RedoxCommand string `datastore:",noindex"`
+	Response     string `datastore:",noindex"`
+	Status       int
 	Timestamp    int64
 	Username     string
 }
 
+// RedoxUsage : Rate limit and quota state of a Redox API key
+type RedoxUsage struct {
+	DailyCount int64   `datastore:",noindex"`
+	Day        int64   `datastore:",noindex"`
+	LastRefill int64   `datastore:",noindex"`
+	Tokens     float64 `datastore:",noindex"`
+	TotalCount int64   `datastore:",noindex"`
+}
+
+// RedoxWebhook : Redox destination registered to a master API key
+type RedoxWebhook struct {
+	MasterAPIKey          string
+	VerificationTokenHash string `datastore:",noindex"`
+}
+
 var empty = struct{}{}
 
 var config = struct {
-	AllowedCyphIDs                *regexp.Regexp
-	AllowedCyphIDLength           int
-	AllowedHeaders                string
-	AllowedMethods                string
-	AllowedHosts                  map[string]none
-	AnalID                        string
-	APIKeyByteLength              int
-	BitPayToken                   string
-	BurnerChannelExpiration       int64
-	CacheControlHeader            string
-	CloudFunctionRoutes           []string
-	ContinentFirebaseRegions      map[string]string
-	Continents                    map[string]none
-	DefaultContinent              string
-	DefaultContinentCode          string
-	DefaultContinentCodeBackup    string
-	DefaultFirebaseRegion         string
-	DefaultLanguageCode           string
-	DefaultPackage                string
-	DummyAnalID                   string
-	DummyCity                     string
-	DummyContinent                string
-	DummyContinentCode            string
-	DummyCountry                  string
-	DummyCountryCode              string
-	DummyPostalCode               string
-	DummyOrg                      string
-	EmailAddress                  string
-	FirebaseProjects              []string
-	FirebaseRegions               []string
-	HPKPHeader                    string
-	HSTSHeader                    string
-	IPFSGatewayUptimeCheckTimeout time.Duration
-	IPFSGatewayUptimeCheckTTL     int64
-	MaxChannelDescriptorLength    int
-	MaxSignupValueLength          int
-	NewCyphTimeout                int64
-	PartnerConversionURL          string
-	PartnerDiscountRate           int64
-	PlanAppleIDs                  map[string]string
-	Plans                         map[string]Plan
-	RootURL                       string
+	AllowedCyphIDs                 *regexp.Regexp
+	AllowedCyphIDLength            int
+	AllowedHeaders                 string
+	AllowedMethods                 string
+	AllowedHosts                   map[string]none
+	AnalID                         string
+	APIKeyByteLength               int
+	BitPayToken                    string
+	BurnerChannelExpiration        int64
+	BurnerChannelPollInterval      time.Duration
+	BurnerChannelWaitTimeout       time.Duration
+	CacheControlHeader             string
+	CloudFunctionRoutes            []string
+	ContinentFirebaseRegions       map[string]string
+	Continents                     map[string]none
+	DefaultContinent               string
+	DefaultContinentCode           string
+	DefaultContinentCodeBackup     string
+	DefaultFirebaseRegion          string
+	DefaultLanguageCode            string
+	DefaultPackage                 string
+	DummyAnalID                    string
+	DummyCity                      string
+	DummyContinent                 string
+	DummyContinentCode             string
+	DummyCountry                   string
+	DummyCountryCode               string
+	DummyPostalCode                string
+	DummyOrg                       string
+	EmailAddress                   string
+	ExpiredEntityCleanupBatchSize  int
+	ExpiredEntityCleanupTimeout    time.Duration
+	FHIRAppointmentReadWindow      int64
+	FHIRAppointmentSearchWindow    int64
+	FHIRPatientIDType              string
+	FHIRPractitionerIDType         string
+	FirebaseProjects               []string
+	FirebaseRegions                []string
+	HPKPHeader                     string
+	HSTSHeader                     string
+	IPFSGatewayCircuitBackoff      int64
+	IPFSGatewayCircuitMaxBackoff   int64
+	IPFSGatewayCircuitThreshold    int
+	IPFSGatewayDistancePenalty     float64
+	IPFSGatewayErrorPenalty        float64
+	IPFSGatewayLeaseDuration       int64
+	IPFSGatewayMaxDistance         float64
+	IPFSGatewayMonitorJitter       time.Duration
+	IPFSGatewayRefreshInterval     time.Duration
+	IPFSGatewayScoreDecay          float64
+	IPFSGatewayUptimeCheckDeadline time.Duration
+	IPFSGatewayUptimeCheckMaxSize  int64
+	IPFSGatewayUptimeCheckTimeout  time.Duration
+	IPFSGatewayUptimeCheckTries    int
+	IPFSGatewayUptimeCheckTTL      int64
+	MaxBurnerChannelParticipants   int64
+	MaxChannelDescriptorLength     int
+	MaxSignupValueLength           int
+	NewCyphTimeout                 int64
+	PackageActiveVersionTTL        int64
+	PackageDatabaseWatchInterval   time.Duration
+	PackageSigningPublicKeys       map[string]string
+	PartnerConversionURL           string
+	PartnerDiscountRate            int64
+	PlanAppleIDs                   map[string]string
+	Plans                          map[string]Plan
+	PreAuthorizationTombstoneTTL   int64
+	RedoxAuthExpirationBuffer      int64
+	RedoxBaseURL                   string
+	RedoxCommandSchemas            map[string]map[string][][]string
+	RedoxDefaultDailyQuota         int64
+	RedoxDefaultRateLimit          int64
+	RedoxDefaultRateLimitBurst     int64
+	RedoxEventRetention            int64
+	RedoxKeyEncryptionKeyFile      string
+	RedoxLogAllowedPaths           [][]string
+	RedoxMasterUsageShards         int
+	RedoxReencryptTransactionSize  int
+	RedoxRequestLogMetadataOnly    bool
+	RedoxRequestLogPageSize        int
+	RedoxRequestLogRetention       int64
+	RedoxWebhookEvents             map[string]map[string]none
+	RedoxWebhookMaxBodySize        int64
+	RootURL                        string
 }{
 	AllowedCyphIDs: regexp.MustCompile("[A-Za-z0-9_-]+$"),
 
 	AllowedCyphIDLength: 7,
 
-	AllowedHeaders: "Access-Control-Request-Method,Authorization,X-Forwarded-For",
+	AllowedHeaders: "Access-Control-Request-Method,Authorization,X-Forwarded-For,X-Redox-Destination",
 
 	AllowedMethods: "GET,HEAD,POST,PUT,DELETE,OPTIONS",
 
@@ -213,6 +381,11 @@ var config = struct {
 
 	BurnerChannelExpiration: 172800000,
 
+	BurnerChannelPollInterval: time.Second,
+
+	/* Kept under typical proxy idle timeouts; clients re-poll on 204 */
+	BurnerChannelWaitTimeout: time.Second * time.Duration(50),
+
 	CacheControlHeader: "no-cache",
 
 	CloudFunctionRoutes: []string{
@@ -288,6 +461,23 @@ var config = struct {
 
 	EmailAddress: "Cyph <hello@cyph.com>",
 
+	/* Datastore caps DeleteMulti at 500 keys */
+	ExpiredEntityCleanupBatchSize: 500,
+
+	/* Leaves headroom within the cron request deadline */
+	ExpiredEntityCleanupTimeout: time.Minute * time.Duration(8),
+
+	/* Redox has no appointment lookup by ID, so reads search the patient's visits this far either side of now */
+	FHIRAppointmentReadWindow: 31536000000,
+
+	/* Default range of Appointment searches without an upper date bound */
+	FHIRAppointmentSearchWindow: 2592000000,
+
+	/* Redox identifier types backing FHIR logical IDs */
+	FHIRPatientIDType: "MR",
+
+	FHIRPractitionerIDType: "NPI",
+
 	FirebaseProjects: []string{
 		"cyphme",
 		"cyph-test-beta",
@@ -311,10 +501,50 @@ var config = struct {
 
 	HSTSHeader: "max-age=31536000; includeSubdomains; preload",
 
+	/* Seconds a gateway is skipped after tripping its circuit breaker, doubling per further failure */
+	IPFSGatewayCircuitBackoff: int64(60),
+
+	IPFSGatewayCircuitMaxBackoff: int64(1800),
+
+	/* Consecutive failed checks before a gateway's circuit breaker opens */
+	IPFSGatewayCircuitThreshold: 3,
+
+	/* Milliseconds of latency a gateway's score is penalized by per kilometer from the client */
+	IPFSGatewayDistancePenalty: 0.05,
+
+	/* Milliseconds of latency a gateway's score is penalized by at a 100% error rate */
+	IPFSGatewayErrorPenalty: 5000,
+
+	/* Seconds another instance waits before taking over the probing of a gateway */
+	IPFSGatewayLeaseDuration: int64(180),
+
+	/* Kilometers from the client within which a gateway counts as nearby */
+	IPFSGatewayMaxDistance: 4000,
+
+	/* Spreads checks out so that gateways aren't all hit at once */
+	IPFSGatewayMonitorJitter: time.Second * time.Duration(10),
+
+	/* How often instances re-read gateway health that other instances probed */
+	IPFSGatewayRefreshInterval: time.Second * time.Duration(30),
+
+	/* Weight of the newest check in a gateway's moving averages */
+	IPFSGatewayScoreDecay: 0.3,
+
+	/* Covers every try of a single check, including retries */
+	IPFSGatewayUptimeCheckDeadline: time.Second * time.Duration(10),
+
+	/* Bytes read from a gateway before giving up on a check */
+	IPFSGatewayUptimeCheckMaxSize: int64(16777216),
+
 	IPFSGatewayUptimeCheckTimeout: time.Millisecond * time.Duration(1500),
 
+	IPFSGatewayUptimeCheckTries: 5,
+
+	/* Seconds a check result stays valid; also paces the gateway monitor */
 	IPFSGatewayUptimeCheckTTL: int64(600),
 
+	MaxBurnerChannelParticipants: 50,
+
 	MaxChannelDescriptorLength: 150,
 
 	/* Max length of a valid email address, but also happened
@@ -325,6 +555,21 @@ var config = struct {
 	still be waiting for Bob */
 	NewCyphTimeout: 2629800000,
 
+	/* Seconds an instance caches which version of a package is active */
+	PackageActiveVersionTTL: int64(60),
+
+	/* How often instances check for a newly published package database */
+	PackageDatabaseWatchInterval: time.Second * time.Duration(30),
+
+	/*
+		The trust root: Ed25519 release public keys (base64) by key ID.
+		PACKAGE_SIGNING_KEY_IDS can only narrow this set. Packages without
+		a valid signature from one of these keys are never served.
+	*/
+	PackageSigningPublicKeys: map[string]string{
+		"release-2026-10": "JM38G0KonKQOsVK3innnR1/aQ39AmnSjnl9HMZ3/eWQ=",
+	},
+
 	PartnerConversionURL: "https://partner-api.cyph.com",
 
 	PartnerDiscountRate: 20,
@@ -335,6 +580,9 @@ var config = struct {
 
 	Plans: map[string]Plan{
 		"0-0": Plan{
+			/* Links work for a week, for any number of joins */
+			PreAuthorizationLifetime: 604800000,
+			PreAuthorizationUses:     -1,
 			ProFeatures: map[string]bool{
 				"disableP2P":     true,
 				"modestBranding": true,
@@ -486,6 +734,9 @@ var config = struct {
 			SessionCountLimit: -1,
 		},
 		"5-1": Plan{
+			/* Links work for a week, for up to ten joins */
+			PreAuthorizationLifetime: 604800000,
+			PreAuthorizationUses:     10,
 			ProFeatures: map[string]bool{
 				"disableP2P":     false,
 				"modestBranding": true,
@@ -497,6 +748,9 @@ var config = struct {
 			SessionCountLimit: -1,
 		},
 		"5-2": Plan{
+			/* Links work for a week, for up to ten joins */
+			PreAuthorizationLifetime: 604800000,
+			PreAuthorizationUses:     10,
 			ProFeatures: map[string]bool{
 				"disableP2P":     false,
 				"modestBranding": true,
@@ -818,5 +1072,125 @@ var config = struct {
 		},
 	},
 
+	/* Milliseconds that expired or used up pre-authorizations keep rejecting their IDs */
+	PreAuthorizationTombstoneTTL: 2629800000,
+
+	/* Refresh Redox tokens an hour before they expire */
+	RedoxAuthExpirationBuffer: 3600000,
+
+	/* Overridden by REDOX_BASE_URL, e.g. to point at redoxsandbox */
+	RedoxBaseURL: "https://api.redoxengine.com",
+
+	/* Supported data model and event type combinations, mapped to their required fields */
+	RedoxCommandSchemas: map[string]map[string][][]string{
+		"ClinicalSummary": map[string][][]string{
+			"PatientQuery": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Patient", "Identifiers"},
+			},
+			"VisitQuery": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Patient", "Identifiers"},
+				[]string{"Visit", "VisitNumber"},
+			},
+		},
+		"Notes": map[string][][]string{
+			"Query": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Patients"},
+			},
+		},
+		"PatientSearch": map[string][][]string{
+			"Query": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Patient"},
+			},
+		},
+		"Provider": map[string][][]string{
+			"ProviderQuery": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Providers"},
+			},
+		},
+		"Results": map[string][][]string{
+			"Query": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"Patients"},
+			},
+		},
+		"Scheduling": map[string][][]string{
+			"AvailableSlots": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"StartDateTime"},
+			},
+			"Booked": [][]string{
+				[]string{"Meta", "Destinations"},
+				[]string{"StartDateTime"},
+				[]string{"EndDateTime"},
+			},
+		},
+	},
+
+	/* Applied to keys without their own limits; -1 on a key disables that limit */
+	RedoxDefaultDailyQuota: 10000,
+
+	/* Requests per minute */
+	RedoxDefaultRateLimit: 60,
+
+	RedoxDefaultRateLimitBurst: 20,
+
+	/* Inbound events are only held until clients have had a chance to fetch them */
+	RedoxEventRetention: 2592000000,
+
+	/* Fallback for REDOX_KEY_ENCRYPTION_KEYS */
+	RedoxKeyEncryptionKeyFile: "redox-keys.txt",
+
+	/*
+		Paths into logged Redox commands and responses that are kept as is;
+		every other value, including Meta.Errors, is replaced with a keyed hash
+	*/
+	RedoxLogAllowedPaths: [][]string{
+		[]string{"EndDateTime"},
+		[]string{"Meta", "DataModel"},
+		[]string{"Meta", "Destinations"},
+		[]string{"Meta", "EventDateTime"},
+		[]string{"Meta", "EventType"},
+		[]string{"Meta", "Message"},
+		[]string{"Meta", "Source"},
+		[]string{"Meta", "Test"},
+		[]string{"Meta", "Transmission"},
+		[]string{"StartDateTime"},
+	},
+
+	/* Usage entities per master key; its rate limit is split evenly between them */
+	RedoxMasterUsageShards: 10,
+
+	/* Entities re-encrypted per transaction; kept small so concurrent updates rarely collide */
+	RedoxReencryptTransactionSize: 25,
+
+	RedoxRequestLogMetadataOnly: false,
+
+	RedoxRequestLogPageSize: 100,
+
+	/* Six years, per HIPAA documentation retention requirements */
+	RedoxRequestLogRetention: 189345600000,
+
+	/* Inbound data model and event type combinations stored for clients */
+	RedoxWebhookEvents: map[string]map[string]none{
+		"Results": map[string]none{
+			"New": empty,
+		},
+		"Scheduling": map[string]none{
+			"Cancel":       empty,
+			"Modification": empty,
+			"New":          empty,
+			"NoShow":       empty,
+			"Reschedule":   empty,
+		},
+	},
+
+	/* Leaves room for encryption overhead within the datastore entity size limit */
+	RedoxWebhookMaxBodySize: 524288,
+
 	RootURL: "http://localhost:42000",
 }
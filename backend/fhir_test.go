@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+/* FHIR tests drive the handlers against redoxsandbox, as commands/redoxtest.sh does */
+func newFHIRTestAPIKey(t *testing.T) string {
+	if os.Getenv("REDOX_BASE_URL") == "" {
+		t.Skip("REDOX_BASE_URL is unset")
+	}
+
+	originalCyphAdminKey := cyphAdminKey
+	cyphAdminKey = generateRandomID()
+	defer func() { cyphAdminKey = originalCyphAdminKey }()
+
+	h, _ := newTestHandlerArgs(t, methods.PUT, "/redox/credentials", url.Values{
+		"cyphAdminKey": {cyphAdminKey},
+		"redoxAPIKey":  {"sandbox-api-key"},
+		"redoxSecret":  {"sandbox-secret"},
+		"username":     {"redoxtest"},
+	})
+
+	masterAPIKey, responseCode := redoxAddCredentials(h)
+	if responseCode != http.StatusOK {
+		t.Fatalf("add credentials: %d %v", responseCode, masterAPIKey)
+	}
+
+	h, _ = newTestHandlerArgs(t, methods.POST, "/redox/apikey/generate", url.Values{
+		"allowedDataModels": {"PatientSearch,Scheduling"},
+		"masterAPIKey":      {masterAPIKey.(string)},
+		"username":          {"redoxtest"},
+	})
+
+	apiKey, responseCode := redoxGenerateAPIKey(h)
+	if responseCode != http.StatusOK {
+		t.Fatalf("generate API key: %d %v", responseCode, apiKey)
+	}
+
+	return apiKey.(string)
+}
+
+func runFHIRTestHandler(
+	t *testing.T,
+	handler Handler,
+	apiKey string,
+	target string,
+	id string,
+) (map[string]interface{}, int) {
+	h, _ := newTestHandlerArgs(t, methods.GET, target, url.Values{})
+
+	h.Request.Header.Set("Authorization", "Bearer "+apiKey)
+	h.Request.Header.Set("X-Redox-Destination", "sandbox")
+	h.Vars["id"] = id
+
+	response, responseCode := handler(h)
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var o map[string]interface{}
+	if err := json.Unmarshal(b, &o); err != nil {
+		t.Fatalf("%s: not a FHIR resource: %v", target, response)
+	}
+
+	return o, responseCode
+}
+
+func TestFHIRPatientRead(t *testing.T) {
+	apiKey := newFHIRTestAPIKey(t)
+
+	patient, responseCode := runFHIRTestHandler(t, fhirReadPatient, apiKey, "/fhir/Patient/0000000001", "0000000001")
+	if responseCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", responseCode, patient)
+	}
+
+	expected := map[string]interface{}{
+		"birthDate":    "2008-01-06",
+		"gender":       "male",
+		"id":           "0000000001",
+		"resourceType": "Patient",
+	}
+
+	for k, v := range expected {
+		if patient[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, patient[k])
+		}
+	}
+
+	if family := getRedoxString(getRedoxList(patient, "name")[0], "family"); family != "Bixby" {
+		t.Errorf("expected family name Bixby, got %q", family)
+	}
+
+	outcome, responseCode := runFHIRTestHandler(t, fhirReadPatient, apiKey, "/fhir/Patient/9999999999", "9999999999")
+	if responseCode != http.StatusNotFound || outcome["resourceType"] != "OperationOutcome" {
+		t.Errorf("expected 404 OperationOutcome, got %d: %v", responseCode, outcome)
+	}
+}
+
+func TestFHIRPatientSearch(t *testing.T) {
+	apiKey := newFHIRTestAPIKey(t)
+
+	for target, total := range map[string]float64{
+		"/fhir/Patient?family=Bixby&given=Timothy": 1,
+		"/fhir/Patient?identifier=9999999999":      0,
+	} {
+		bundle, responseCode := runFHIRTestHandler(t, fhirSearchPatients, apiKey, target, "")
+
+		if responseCode != http.StatusOK || bundle["type"] != "searchset" {
+			t.Errorf("%s: expected searchset Bundle, got %d: %v", target, responseCode, bundle)
+		} else if bundle["total"] != total {
+			t.Errorf("%s: expected total %v, got %v", target, total, bundle["total"])
+		}
+	}
+
+	if _, responseCode := runFHIRTestHandler(t, fhirSearchPatients, apiKey, "/fhir/Patient", ""); responseCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without search parameters, got %d", responseCode)
+	}
+}
+
+func TestFHIRAppointmentRead(t *testing.T) {
+	apiKey := newFHIRTestAPIKey(t)
+
+	id := "0000000001.1234"
+
+	appointment, responseCode := runFHIRTestHandler(t, fhirReadAppointment, apiKey, "/fhir/Appointment/"+id, id)
+	if responseCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", responseCode, appointment)
+	}
+
+	expected := map[string]interface{}{
+		"description":     "Annual physical",
+		"id":              id,
+		"minutesDuration": float64(15),
+		"resourceType":    "Appointment",
+		"status":          "booked",
+	}
+
+	for k, v := range expected {
+		if appointment[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, appointment[k])
+		}
+	}
+
+	participants := getRedoxList(appointment, "participant")
+	if len(participants) != 3 {
+		t.Fatalf("expected patient, practitioner and location participants, got %v", participants)
+	}
+
+	references := []string{
+		getRedoxString(participants[0], "actor", "reference"),
+		getRedoxString(participants[1], "actor", "reference"),
+		getRedoxString(participants[2], "actor", "display"),
+	}
+
+	for i, v := range []string{"Patient/0000000001", "Practitioner/4356789876", "RES General Hospital 3N"} {
+		if references[i] != v {
+			t.Errorf("participant %d: expected %s, got %s", i, v, references[i])
+		}
+	}
+
+	/* Visit 1234 belongs to patient 0000000001, and reads without a patient are never run */
+	for _, id := range []string{"0000000002.1234", "1234"} {
+		outcome, responseCode := runFHIRTestHandler(t, fhirReadAppointment, apiKey, "/fhir/Appointment/"+id, id)
+		if responseCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d: %v", id, responseCode, outcome)
+		}
+	}
+}
+
+func TestFHIRAppointmentSearch(t *testing.T) {
+	apiKey := newFHIRTestAPIKey(t)
+
+	bundle, responseCode := runFHIRTestHandler(
+		t,
+		fhirSearchAppointments,
+		apiKey,
+		"/fhir/Appointment?patient=Patient/0000000001",
+		"",
+	)
+	if responseCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", responseCode, bundle)
+	}
+
+	if bundle["total"] != float64(1) {
+		t.Fatalf("expected total 1, got %v", bundle["total"])
+	}
+
+	if id := getRedoxString(getRedoxList(bundle, "entry")[0], "resource", "id"); id != "0000000001.1234" {
+		t.Errorf("expected Appointment/0000000001.1234, got %s", id)
+	}
+}
+
+func TestFHIRRestrictedPractitioner(t *testing.T) {
+	apiKey := newFHIRTestAPIKey(t)
+
+	outcome, responseCode := runFHIRTestHandler(
+		t,
+		fhirReadPractitioner,
+		apiKey,
+		"/fhir/Practitioner/4356789876",
+		"4356789876",
+	)
+
+	if responseCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %v", responseCode, outcome)
+	}
+
+	if code := getRedoxString(getRedoxList(outcome, "issue")[0], "code"); code != "security" {
+		t.Errorf("expected security OperationOutcome, got %s", code)
+	}
+}
@@ -2,12 +2,23 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -17,8 +28,10 @@ import (
 	"net/smtp"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -27,6 +40,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/oschwald/geoip2-golang"
+	"google.golang.org/api/iterator"
 	"google.golang.org/appengine"
 )
 
@@ -139,28 +153,221 @@ var analIDs = func() map[string]string {
 	return o
 }()
 
-var ipfsGatewayUptimeChecks = map[string]IPFSGatewayUptimeCheckData{}
+var errBurnerChannelNotFound = errors.New("channel not found")
 
-var ipfsGatewayURLs = func() []IPFSGatewayData {
+var errIPFSGatewayIntegrity = errors.New("integrity check failed")
+
+var errRedoxRateLimited = errors.New("rate limit exceeded")
+
+var redoxAuthCache = struct {
+	sync.Mutex
+	auth      map[string]*RedoxAuth
+	refreshes map[string]*RedoxAuthRefresh
+}{
+	auth:      map[string]*RedoxAuth{},
+	refreshes: map[string]*RedoxAuthRefresh{},
+}
+
+/* Comma-separated "id:base64key" pairs; the first encrypts new writes, the rest are kept for rotation */
+var redoxKeyEncryptionKeys = func() RedoxKeyEncryptionKeys {
+	o := RedoxKeyEncryptionKeys{Keys: map[string][]byte{}}
+
+	keysString := os.Getenv("REDOX_KEY_ENCRYPTION_KEYS")
+	if keysString == "" {
+		if b, err := ioutil.ReadFile(config.RedoxKeyEncryptionKeyFile); err == nil {
+			keysString = string(b)
+		}
+	}
+
+	for _, keyString := range strings.Split(strings.TrimSpace(keysString), ",") {
+		keyData := strings.SplitN(strings.TrimSpace(keyString), ":", 2)
+		if len(keyData) != 2 {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(keyData[1])
+		if err != nil || len(key) != 32 {
+			log.Printf("Ignoring invalid Redox key-encryption key %s", keyData[0])
+			continue
+		}
+
+		if o.CurrentID == "" {
+			o.CurrentID = keyData[0]
+		}
+
+		o.Keys[keyData[0]] = key
+	}
+
+	return o
+}()
+
+var redoxBaseURL = func() string {
+	if redoxBaseURL := os.Getenv("REDOX_BASE_URL"); redoxBaseURL != "" {
+		return strings.TrimSuffix(redoxBaseURL, "/")
+	}
+
+	return config.RedoxBaseURL
+}()
+
+/* Without it, redacted values could be brute-forced, so request logs hold metadata only */
+var redoxLogHashSecret = func() []byte {
+	secret := os.Getenv("REDOX_LOG_HASH_SECRET")
+	if secret == "" {
+		log.Println("REDOX_LOG_HASH_SECRET is unset; Redox request bodies will not be logged")
+	}
+
+	return []byte(secret)
+}()
+
+/* Identifies this instance as an IPFS gateway lease holder */
+var instanceID = func() string {
+	if instanceID := os.Getenv("GAE_INSTANCE"); instanceID != "" {
+		return instanceID
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+/* Re-checks each gateway early enough that results shared with other instances are re-read before they expire */
+var ipfsGatewayMonitorInterval = time.Second*time.Duration(config.IPFSGatewayUptimeCheckTTL) -
+	config.IPFSGatewayMonitorJitter -
+	config.IPFSGatewayUptimeCheckDeadline -
+	config.IPFSGatewayRefreshInterval
+
+/* Written by the gateway monitor and admin calls; request handlers read from it */
+var ipfsGatewayUptimeChecks = struct {
+	sync.RWMutex
+	checks    map[string]IPFSGatewayUptimeCheckData
+	content   map[string]map[string]IPFSGatewayContentCheckData
+	monitored map[string]bool
+}{
+	checks:    map[string]IPFSGatewayUptimeCheckData{},
+	content:   map[string]map[string]IPFSGatewayContentCheckData{},
+	monitored: map[string]bool{},
+}
+
+/* Pinned in config.PackageSigningPublicKeys; PACKAGE_SIGNING_KEY_IDS (comma-separated) only narrows the set */
+var packageSigningPublicKeys = func() map[string]ed25519.PublicKey {
+	o := map[string]ed25519.PublicKey{}
+
+	keyIDs := map[string]bool{}
+	if keyIDsString := os.Getenv("PACKAGE_SIGNING_KEY_IDS"); keyIDsString != "" {
+		for _, keyID := range strings.Split(keyIDsString, ",") {
+			keyIDs[strings.TrimSpace(keyID)] = true
+		}
+	}
+
+	for keyID, keyString := range config.PackageSigningPublicKeys {
+		if len(keyIDs) > 0 && !keyIDs[keyID] {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(keyString)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Printf("Ignoring invalid package signing key %s", keyID)
+			continue
+		}
+
+		o[keyID] = ed25519.PublicKey(key)
+	}
+
+	if len(o) < 1 {
+		log.Println("No usable package signing keys; every package will be refused")
+	}
+
+	return o
+}()
+
+/* packages holds the latest version of each package; active holds rollbacks, cached per instance */
+var packageDatabase = struct {
+	sync.RWMutex
+	active            map[string]PackageData
+	activeExpires     map[string]int64
+	deployedTimestamp int64
+	gatewayURLs       []IPFSGatewayData
+	gateways          map[string][]string
+	packages          map[string]PackageData
+	published         int64 /* 0 while the deployed files are in use */
+	recorded          map[string]int64
+	refused           map[string]string
+	rejected          int64
+}{
+	active:        map[string]PackageData{},
+	activeExpires: map[string]int64{},
+	gatewayURLs:   []IPFSGatewayData{},
+	gateways:      map[string][]string{},
+	packages:      map[string]PackageData{},
+	recorded:      map[string]int64{},
+	refused:       map[string]string{},
+}
+
+var _ = func() error {
 	if appengine.IsDevAppServer() {
-		return []IPFSGatewayData{}
+		return nil
 	}
 
-	b, err := ioutil.ReadFile("ipfs-gateways.json")
-	if err != nil {
-		panic(err)
+	/* Crashing would only restart into the same files; a valid database can still be published */
+	if err := reloadPackageDatabase(); err != nil {
+		log.Printf("Serving no packages until a valid package database is published: %v", err)
+	}
+
+	return nil
+}()
+
+func getIPFSGatewayURLs() []IPFSGatewayData {
+	packageDatabase.RLock()
+	defer packageDatabase.RUnlock()
+
+	return packageDatabase.gatewayURLs
+}
+
+func getContinentIPFSGateways(continentCode string) []string {
+	packageDatabase.RLock()
+	defer packageDatabase.RUnlock()
+
+	return packageDatabase.gateways[continentCode]
+}
+
+func getPackageData(packageName string) (PackageData, bool) {
+	packageDatabase.RLock()
+	defer packageDatabase.RUnlock()
+
+	packageData, ok := packageDatabase.packages[packageName]
+	return packageData, ok
+}
+
+func getRefusedPackages() map[string]string {
+	packageDatabase.RLock()
+	defer packageDatabase.RUnlock()
+
+	return packageDatabase.refused
+}
+
+func getPackageNames() []string {
+	packageDatabase.RLock()
+	defer packageDatabase.RUnlock()
+
+	packageNames := []string{}
+	for packageName := range packageDatabase.packages {
+		packageNames = append(packageNames, packageName)
 	}
 
+	sort.Strings(packageNames)
+	return packageNames
+}
+
+func parseIPFSGatewayURLs(b []byte) ([]IPFSGatewayData, map[string][]string, error) {
 	var gatewayURLs []IPFSGatewayData
-	err = json.Unmarshal(b, &gatewayURLs)
-	if err != nil {
-		panic(err)
+	if err := json.Unmarshal(b, &gatewayURLs); err != nil {
+		return nil, nil, fmt.Errorf("ipfs-gateways.json: %v", err)
 	}
 
-	return gatewayURLs
-}()
+	if len(gatewayURLs) < 1 {
+		return nil, nil, errors.New("ipfs-gateways.json: no gateways")
+	}
 
-var ipfsGateways = func() map[string][]string {
 	gateways := map[string][]string{
 		"af": []string{},
 		"an": []string{},
@@ -171,15 +378,44 @@ var ipfsGateways = func() map[string][]string {
 		"sa": []string{},
 	}
 
-	if appengine.IsDevAppServer() {
-		return gateways
-	}
+	seen := map[string]bool{}
 
-	for i := range ipfsGatewayURLs {
-		continentCode := ipfsGatewayURLs[i].ContinentCode
-		url := ipfsGatewayURLs[i].URL
+	/* Gateways with several locations, such as anycast CDNs, have one entry per location */
+	for i := range gatewayURLs {
+		gatewayURLs[i].CountryCode = strings.ToLower(gatewayURLs[i].CountryCode)
+		gatewayURLs[i].HasCoordinates = gatewayURLs[i].Latitude != 0 || gatewayURLs[i].Longitude != 0
 
-		gateways[continentCode] = append(gateways[continentCode], url)
+		continentCode := gatewayURLs[i].ContinentCode
+		gatewayURL := gatewayURLs[i].URL
+
+		if _, ok := gateways[continentCode]; !ok {
+			return nil, nil, fmt.Errorf("ipfs-gateways.json: invalid continent code %q for %s", continentCode, gatewayURL)
+		}
+
+		if !strings.Contains(gatewayURL, ":hash") {
+			return nil, nil, fmt.Errorf("ipfs-gateways.json: %s is missing :hash", gatewayURL)
+		}
+
+		if u, err := url.Parse(gatewayURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, nil, fmt.Errorf("ipfs-gateways.json: %s is not a valid HTTPS URL", gatewayURL)
+		}
+
+		if math.Abs(gatewayURLs[i].Latitude) > 90 || math.Abs(gatewayURLs[i].Longitude) > 180 {
+			return nil, nil, fmt.Errorf("ipfs-gateways.json: invalid coordinates for %s", gatewayURL)
+		}
+
+		if countryCode := gatewayURLs[i].CountryCode; countryCode != "" && len(countryCode) != 2 {
+			return nil, nil, fmt.Errorf("ipfs-gateways.json: invalid country code %q for %s", countryCode, gatewayURL)
+		}
+
+		if !seen[continentCode+" "+gatewayURL] {
+			seen[continentCode+" "+gatewayURL] = true
+			gateways[continentCode] = append(gateways[continentCode], gatewayURL)
+		}
+	}
+
+	if len(gateways[config.DefaultContinentCode]) < 1 {
+		return nil, nil, fmt.Errorf("ipfs-gateways.json: no gateways for default continent %s", config.DefaultContinentCode)
 	}
 
 	for k := range gateways {
@@ -188,720 +424,3598 @@ var ipfsGateways = func() map[string][]string {
 		}
 	}
 
-	return gateways
-}()
+	return gatewayURLs, gateways, nil
+}
 
-var packages = func() map[string]PackageData {
-	if appengine.IsDevAppServer() {
-		return map[string]PackageData{}
+/* Packages that fail signature verification are refused individually, with the reason */
+func parsePackages(b []byte) (map[string]PackageData, map[string]string, error) {
+	var packages map[string]PackageData
+	if err := json.Unmarshal(b, &packages); err != nil {
+		return nil, nil, fmt.Errorf("packages.json: %v", err)
+	}
+
+	refused := map[string]string{}
+
+	for packageName, packageData := range packages {
+		if packageData.Package == nil {
+			return nil, nil, fmt.Errorf("packages.json: %s has no package", packageName)
+		}
+
+		if packageData.Timestamp <= 0 {
+			return nil, nil, fmt.Errorf("packages.json: %s has an invalid timestamp", packageName)
+		}
+
+		if (packageData.Uptime.IPFSHash == "") != (packageData.Uptime.IntegrityHash == "") {
+			return nil, nil, fmt.Errorf("packages.json: %s has incomplete uptime data", packageName)
+		}
+
+		if packageData.Uptime.IntegrityHash != "" {
+			if _, _, err := parseIntegrityHash(packageData.Uptime.IntegrityHash); err != nil {
+				return nil, nil, fmt.Errorf("packages.json: %s: %v", packageName, err)
+			}
+		}
+
+		verified, err := verifyPackageSignature(packageName, packageData)
+		if err != nil {
+			log.Printf("Refusing package %s: %v", packageName, err)
+			refused[packageName] = err.Error()
+			delete(packages, packageName)
+			continue
+		}
+
+		packageData.Verified = verified
+		packages[packageName] = packageData
+	}
+
+	if _, ok := packages[config.DefaultPackage]; !ok {
+		if reason, ok := refused[config.DefaultPackage]; ok {
+			return nil, nil, fmt.Errorf("packages.json: default package %s refused: %s", config.DefaultPackage, reason)
+		}
+
+		return nil, nil, fmt.Errorf("packages.json: missing default package %s", config.DefaultPackage)
 	}
 
-	b, err := ioutil.ReadFile("packages.json")
+	return packages, refused, nil
+}
+
+/* Canonical JSON (sorted keys, no HTML escaping) of everything the signature covers; must match commands/packagedatabase.js */
+func getPackageSigningMessage(packageName string, packageData PackageData) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(map[string]interface{}{
+		"name":      packageName,
+		"package":   packageData.Package,
+		"timestamp": packageData.Timestamp,
+		"uptime": map[string]string{
+			"integrityHash": packageData.Uptime.IntegrityHash,
+			"ipfsHash":      packageData.Uptime.IPFSHash,
+		},
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func verifyPackageSignature(packageName string, packageData PackageData) (bool, error) {
+	if packageData.Signature == "" {
+		return false, errors.New("unsigned")
+	}
+
+	publicKey, ok := packageSigningPublicKeys[packageData.KeyID]
+	if !ok {
+		return false, fmt.Errorf("untrusted signing key %q", packageData.KeyID)
 	}
 
-	var o map[string]PackageData
-	err = json.Unmarshal(b, &o)
+	signature, err := base64.StdEncoding.DecodeString(packageData.Signature)
 	if err != nil {
-		panic(err)
+		return false, errors.New("malformed signature")
 	}
 
-	return o
-}()
+	message, err := getPackageSigningMessage(packageName, packageData)
+	if err != nil {
+		return false, err
+	}
 
-func datastoreKey(kind string, name string) *datastore.Key {
-	key := datastore.NameKey(kind, name, nil)
-	key.Namespace = apiNamespace
-	return key
+	if !ed25519.Verify(publicKey, message, signature) {
+		return false, errors.New("invalid signature")
+	}
+
+	return true, nil
 }
 
-func datastoreQuery(kind string) *datastore.Query {
-	return datastore.NewQuery(kind).Namespace(apiNamespace)
+/* The newest package timestamp, used to tell whether a deployment or a publish is more recent */
+func getPackagesTimestamp(packages map[string]PackageData) int64 {
+	timestamp := int64(0)
+	for _, packageData := range packages {
+		if packageData.Timestamp > timestamp {
+			timestamp = packageData.Timestamp
+		}
+	}
+
+	return timestamp
 }
 
-func isValidCyphID(id string) bool {
-	return len(id) >= config.AllowedCyphIDLength && config.AllowedCyphIDs.MatchString(id)
+/* Nothing is swapped in unless both packages and gateways are valid */
+func setPackageDatabase(packagesJSON []byte, ipfsGatewaysJSON []byte, published int64) error {
+	packages, refused, err := parsePackages(packagesJSON)
+	if err != nil {
+		return err
+	}
+
+	gatewayURLs, gateways, err := parseIPFSGatewayURLs(ipfsGatewaysJSON)
+	if err != nil {
+		return err
+	}
+
+	packageDatabase.Lock()
+	defer packageDatabase.Unlock()
+
+	packageDatabase.gatewayURLs = gatewayURLs
+	packageDatabase.gateways = gateways
+	packageDatabase.packages = packages
+	packageDatabase.published = published
+	packageDatabase.refused = refused
+
+	packageDatabase.active = map[string]PackageData{}
+	packageDatabase.activeExpires = map[string]int64{}
+
+	if published == 0 {
+		packageDatabase.deployedTimestamp = getPackagesTimestamp(packages)
+	}
+
+	return nil
 }
 
-func generateRandomID() string {
-	bytes := make([]byte, config.APIKeyByteLength)
-	if _, err := rand.Read(bytes); err != nil {
-		return ""
+func readDeployedPackageDatabase() ([]byte, []byte, error) {
+	packagesJSON, err := ioutil.ReadFile("packages.json")
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return hex.EncodeToString(bytes)
+	ipfsGatewaysJSON, err := ioutil.ReadFile("ipfs-gateways.json")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return packagesJSON, ipfsGatewaysJSON, nil
 }
 
-func generateAPIKey(h HandlerArgs, kind string) (string, *datastore.Key, error) {
-	apiKey := generateRandomID()
-	datastoreKey := datastoreKey(kind, apiKey)
+func reloadPackageDatabase() error {
+	packagesJSON, ipfsGatewaysJSON, err := readDeployedPackageDatabase()
+	if err != nil {
+		return err
+	}
 
-	it := h.Datastore.Run(
-		h.Context,
-		datastoreQuery(kind).Filter("__key__ =", datastoreKey),
-	)
+	return setPackageDatabase(packagesJSON, ipfsGatewaysJSON, 0)
+}
 
-	if _, err := it.Next(nil); err == nil {
-		return generateAPIKey(h, kind)
+func gzipPackageDatabaseJSON(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	gzipWriter := gzip.NewWriter(buf)
+	if _, err := gzipWriter.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
 	}
 
-	return apiKey, datastoreKey, nil
+	return buf.Bytes(), nil
 }
 
-func geolocate(h HandlerArgs) (string, string, string, string, string, string, string, string) {
-	if appengine.IsDevAppServer() {
-		return config.DummyContinent,
-			config.DummyContinentCode,
-			config.DummyCountry,
-			config.DummyCountryCode,
-			config.DummyCity,
-			config.DummyPostalCode,
-			config.DummyAnalID,
-			config.DefaultFirebaseRegion
+func gunzipPackageDatabaseJSON(b []byte) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
 	}
+	defer gzipReader.Close()
 
-	record, err := geodb.City(getIP(h))
+	return ioutil.ReadAll(gzipReader)
+}
+
+/* Validated and verified here first, then again by every instance that loads it */
+func publishPackageDatabase(h HandlerArgs, packagesJSON []byte, ipfsGatewaysJSON []byte) error {
+	packages, _, err := parsePackages(packagesJSON)
 	if err != nil {
-		return config.DefaultContinent,
-			config.DefaultContinentCode,
-			"",
-			"",
-			"",
-			"",
-			"",
-			config.DefaultFirebaseRegion
+		return err
 	}
 
-	language := config.DefaultLanguageCode
-	if val, ok := h.Vars["language"]; ok {
-		language = val
+	if _, _, err := parseIPFSGatewayURLs(ipfsGatewaysJSON); err != nil {
+		return err
 	}
 
-	continent := ""
-	continentCode := strings.ToLower(record.Continent.Code)
-	if val, ok := record.Continent.Names[language]; ok {
-		continent = val
-	} else if val, ok := record.Continent.Names[config.DefaultLanguageCode]; ok {
-		continent = val
+	packagesTimestamp := getPackagesTimestamp(packages)
+
+	packageDatabase.RLock()
+	deployedTimestamp := packageDatabase.deployedTimestamp
+	packageDatabase.RUnlock()
+
+	if packagesTimestamp < deployedTimestamp {
+		return errors.New("packages are older than the deployed package database")
 	}
 
-	if _, ok := config.Continents[continentCode]; !ok {
-		continent = config.DefaultContinent
-		continentCode = config.DefaultContinentCode
+	gzippedPackages, err := gzipPackageDatabaseJSON(packagesJSON)
+	if err != nil {
+		return err
+	}
+
+	gzippedIPFSGateways, err := gzipPackageDatabaseJSON(ipfsGatewaysJSON)
+	if err != nil {
+		return err
+	}
+
+	published := getTimestamp()
+
+	if _, err := h.Datastore.Put(h.Context, datastoreKey("PackageDatabase", "current"), &PackageDatabase{
+		IPFSGateways:      gzippedIPFSGateways,
+		Packages:          gzippedPackages,
+		PackagesTimestamp: packagesTimestamp,
+		Timestamp:         published,
+	}); err != nil {
+		return err
+	}
+
+	return setPackageDatabase(packagesJSON, ipfsGatewaysJSON, published)
+}
+
+/* A newer deployment takes precedence over an older publish; a bad publish is only reported once */
+func syncPackageDatabase(h HandlerArgs) error {
+	sharedPackageDatabase := &PackageDatabase{}
+
+	err := h.Datastore.Get(h.Context, datastoreKey("PackageDatabase", "current"), sharedPackageDatabase)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	country := ""
-	countryCode := strings.ToLower(record.Country.IsoCode)
-	if val, ok := record.Country.Names[language]; ok {
-		country = val
-	} else if val, ok := record.Country.Names[config.DefaultLanguageCode]; ok {
-		country = val
+	packageDatabase.RLock()
+	current := sharedPackageDatabase.Timestamp == packageDatabase.published ||
+		sharedPackageDatabase.Timestamp == packageDatabase.rejected ||
+		sharedPackageDatabase.PackagesTimestamp < packageDatabase.deployedTimestamp
+	packageDatabase.RUnlock()
+
+	if current {
+		return nil
+	}
+
+	err = func() error {
+		packagesJSON, err := gunzipPackageDatabaseJSON(sharedPackageDatabase.Packages)
+		if err != nil {
+			return err
+		}
+
+		ipfsGatewaysJSON, err := gunzipPackageDatabaseJSON(sharedPackageDatabase.IPFSGateways)
+		if err != nil {
+			return err
+		}
+
+		return setPackageDatabase(packagesJSON, ipfsGatewaysJSON, sharedPackageDatabase.Timestamp)
+	}()
+
+	if err != nil {
+		packageDatabase.Lock()
+		packageDatabase.rejected = sharedPackageDatabase.Timestamp
+		packageDatabase.Unlock()
+
+		return err
+	}
+
+	log.Printf("Loaded package database published at %d", sharedPackageDatabase.Timestamp)
+
+	return nil
+}
+
+func getPackageVersionKeyName(packageName string, timestamp int64) string {
+	return fmt.Sprintf("%s:%015d", packageName, timestamp)
+}
+
+/* Saves the latest version of a package to the version history, once per instance */
+func recordPackageVersion(h HandlerArgs, packageName string, packageData PackageData) error {
+	packageDatabase.RLock()
+	recorded := packageDatabase.recorded[packageName] == packageData.Timestamp
+	packageDatabase.RUnlock()
+
+	if recorded {
+		return nil
+	}
+
+	packageJSON, err := json.Marshal(packageData.Package)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.Datastore.Put(
+		h.Context,
+		datastoreKey("PackageVersion", getPackageVersionKeyName(packageName, packageData.Timestamp)),
+		&PackageVersion{
+			IntegrityHash: packageData.Uptime.IntegrityHash,
+			IPFSHash:      packageData.Uptime.IPFSHash,
+			KeyID:         packageData.KeyID,
+			Name:          packageName,
+			Package:       packageJSON,
+			Signature:     packageData.Signature,
+			Timestamp:     packageData.Timestamp,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	packageDatabase.Lock()
+	packageDatabase.recorded[packageName] = packageData.Timestamp
+	packageDatabase.Unlock()
+
+	return nil
+}
+
+/* Stored versions are verified again before use, since the pinned keys may have changed since they were saved */
+func getPackageVersion(h HandlerArgs, packageName string, timestamp int64) (PackageData, error) {
+	if packageData, ok := getPackageData(packageName); ok && packageData.Timestamp == timestamp {
+		return packageData, nil
+	}
+
+	packageVersion := &PackageVersion{}
+	err := h.Datastore.Get(
+		h.Context,
+		datastoreKey("PackageVersion", getPackageVersionKeyName(packageName, timestamp)),
+		packageVersion,
+	)
+	if err != nil {
+		return PackageData{}, err
+	}
+
+	packageData := PackageData{
+		KeyID:     packageVersion.KeyID,
+		Signature: packageVersion.Signature,
+		Timestamp: packageVersion.Timestamp,
+		Uptime: IPFSGatewayUptimeData{
+			IntegrityHash: packageVersion.IntegrityHash,
+			IPFSHash:      packageVersion.IPFSHash,
+		},
+	}
+
+	if err = json.Unmarshal(packageVersion.Package, &packageData.Package); err != nil {
+		return PackageData{}, err
+	}
+
+	if packageData.Verified, err = verifyPackageSignature(packageName, packageData); err != nil {
+		return PackageData{}, err
+	}
+
+	return packageData, nil
+}
+
+/* Falls back to the latest version if no rollback is in effect or the rolled back version can't be loaded */
+func getActivePackage(h HandlerArgs, packageName string) (PackageData, bool) {
+	latest, ok := getPackageData(packageName)
+	if !ok {
+		return PackageData{}, false
+	}
+
+	if err := recordPackageVersion(h, packageName, latest); err != nil {
+		log.Printf("Failed to record version %d of package %s: %v", latest.Timestamp, packageName, err)
+	}
+
+	now := time.Now().Unix()
+
+	packageDatabase.RLock()
+	active, ok := packageDatabase.active[packageName]
+	expires := packageDatabase.activeExpires[packageName]
+	packageDatabase.RUnlock()
+
+	if ok && expires > now {
+		return active, true
+	}
+
+	active = latest
+
+	activeVersion := &PackageActiveVersion{}
+	err := h.Datastore.Get(h.Context, datastoreKey("PackageActiveVersion", packageName), activeVersion)
+
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("Failed to get active version of package %s: %v", packageName, err)
+	} else if err == nil && activeVersion.Timestamp != 0 && activeVersion.Timestamp != latest.Timestamp {
+		if packageData, err := getPackageVersion(h, packageName, activeVersion.Timestamp); err == nil {
+			active = packageData
+		} else {
+			log.Printf("Failed to load active version %d of package %s: %v", activeVersion.Timestamp, packageName, err)
+		}
+	}
+
+	setActivePackage(packageName, active)
+
+	return active, true
+}
+
+func setActivePackage(packageName string, packageData PackageData) {
+	packageDatabase.Lock()
+	defer packageDatabase.Unlock()
+
+	packageDatabase.active[packageName] = packageData
+	packageDatabase.activeExpires[packageName] = time.Now().Unix() + config.PackageActiveVersionTTL
+}
+
+/* For callers without a request, such as the gateway monitor; uses whatever version requests last saw as active */
+func getCachedActivePackage(packageName string) (PackageData, bool) {
+	packageDatabase.RLock()
+	active, ok := packageDatabase.active[packageName]
+	packageDatabase.RUnlock()
+
+	if ok {
+		return active, true
+	}
+
+	return getPackageData(packageName)
+}
+
+/* Runs for the lifetime of the instance; deployed files never change, so updates are published through the datastore */
+func watchPackageDatabase() {
+	if appengine.IsDevAppServer() {
+		return
+	}
+
+	h, err := newBackgroundHandlerArgs()
+	if err != nil {
+		log.Printf("Failed to watch package database: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(config.PackageDatabaseWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := syncPackageDatabase(h); err != nil {
+			log.Printf("Keeping previous package database; sync failed: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+func datastoreKey(kind string, name string) *datastore.Key {
+	key := datastore.NameKey(kind, name, nil)
+	key.Namespace = apiNamespace
+	return key
+}
+
+func datastoreQuery(kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Namespace(apiNamespace)
+}
+
+func isValidCyphID(id string) bool {
+	return len(id) >= config.AllowedCyphIDLength && config.AllowedCyphIDs.MatchString(id)
+}
+
+func generateRandomID() string {
+	bytes := make([]byte, config.APIKeyByteLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(bytes)
+}
+
+func generateAPIKey(h HandlerArgs, kind string) (string, *datastore.Key, error) {
+	apiKey := generateRandomID()
+	datastoreKey := datastoreKey(kind, apiKey)
+
+	it := h.Datastore.Run(
+		h.Context,
+		datastoreQuery(kind).Filter("__key__ =", datastoreKey),
+	)
+
+	if _, err := it.Next(nil); err == nil {
+		return generateAPIKey(h, kind)
+	}
+
+	return apiKey, datastoreKey, nil
+}
+
+/* A channel past either threshold can no longer be joined */
+func getBurnerChannelExpiration() int64 {
+	if config.NewCyphTimeout < config.BurnerChannelExpiration {
+		return config.NewCyphTimeout
+	}
+
+	return config.BurnerChannelExpiration
+}
+
+/* Channels created without a participant cap keep two-party semantics */
+func isGroupBurnerChannel(burnerChannel *BurnerChannel) bool {
+	return burnerChannel.MaxParticipants > 2
+}
+
+func hashBurnerChannelOwnerKey(ownerKey string) string {
+	hash := sha256.Sum256([]byte(ownerKey))
+	return hex.EncodeToString(hash[:])
+}
+
+/* Pre-authorizations issued before lifetimes were configurable default to the channel expiration */
+func getPreAuthorizationLifetime(preAuthorizedCyph *PreAuthorizedCyph) int64 {
+	if preAuthorizedCyph.Lifetime > 0 {
+		return preAuthorizedCyph.Lifetime
+	}
+
+	return config.BurnerChannelExpiration
+}
+
+/* Zero means single use, as for pre-authorizations issued before use counts were configurable */
+func getPreAuthorizationMaxUses(preAuthorizedCyph *PreAuthorizedCyph) int64 {
+	if preAuthorizedCyph.MaxUses == 0 {
+		return 1
+	}
+
+	return preAuthorizedCyph.MaxUses
+}
+
+/* Expired and used up pre-authorizations are kept as tombstones, so that their IDs keep being rejected */
+func getPreAuthorizationError(preAuthorizedCyph *PreAuthorizedCyph, now int64) string {
+	if now-preAuthorizedCyph.Timestamp > getPreAuthorizationLifetime(preAuthorizedCyph) {
+		return "pre-authorization expired"
+	}
+
+	maxUses := getPreAuthorizationMaxUses(preAuthorizedCyph)
+	if maxUses != -1 && preAuthorizedCyph.UseCount >= maxUses {
+		return "pre-authorization used up"
+	}
+
+	return ""
+}
+
+/* Channels set up under a pre-authorization with its own lifetime stay joinable until it expires */
+func getBurnerChannelLifetime(burnerChannel *BurnerChannel) int64 {
+	if burnerChannel.Lifetime > 0 {
+		return burnerChannel.Lifetime
+	}
+
+	return getBurnerChannelExpiration()
+}
+
+func getMaxPreAuthorizationLifetime() int64 {
+	lifetime := config.BurnerChannelExpiration
+
+	for _, plan := range config.Plans {
+		if plan.PreAuthorizationLifetime > lifetime {
+			lifetime = plan.PreAuthorizationLifetime
+		}
+	}
+
+	return lifetime
+}
+
+func waitForBurnerChannelJoin(h HandlerArgs, id string, channelID string, timeout time.Duration) (int64, error) {
+	burnerChannelKey := datastoreKey("BurnerChannel", id)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		burnerChannel := &BurnerChannel{}
+
+		if err := h.Datastore.Get(h.Context, burnerChannelKey, burnerChannel); err != nil && err != datastore.ErrNoSuchEntity {
+			return 0, err
+		}
+
+		/* Only the initiator knows the channel descriptor */
+		if channelID == "" ||
+			burnerChannel.ChannelID != channelID ||
+			getTimestamp()-burnerChannel.Timestamp > getBurnerChannelLifetime(burnerChannel) {
+			return 0, errBurnerChannelNotFound
+		}
+
+		if burnerChannel.JoinTimestamp != 0 {
+			return burnerChannel.JoinTimestamp, nil
+		}
+
+		if !time.Now().Add(config.BurnerChannelPollInterval).Before(deadline) {
+			return 0, nil
+		}
+
+		select {
+		case <-h.Context.Done():
+			return 0, h.Context.Err()
+		case <-time.After(config.BurnerChannelPollInterval):
+		}
+	}
+}
+
+func deleteExpiredEntities(h HandlerArgs, kind string, cutoff int64, deadline time.Time) (int, error) {
+	deleted := 0
+
+	for time.Now().Before(deadline) {
+		keys, err := h.Datastore.GetAll(
+			h.Context,
+			datastoreQuery(kind).
+				Filter("Timestamp <", cutoff).
+				KeysOnly().
+				Limit(config.ExpiredEntityCleanupBatchSize),
+			nil,
+		)
+
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) < 1 {
+			break
+		}
+
+		if err = h.Datastore.DeleteMulti(h.Context, keys); err != nil {
+			return deleted, err
+		}
+
+		deleted += len(keys)
+
+		if len(keys) < config.ExpiredEntityCleanupBatchSize {
+			break
+		}
+	}
+
+	return deleted, nil
+}
+
+/* Coordinates are only set when GeoIP2 has them for the client; codes match geolocate */
+func geolocateCoordinates(h HandlerArgs) GeoLocation {
+	if appengine.IsDevAppServer() {
+		return GeoLocation{
+			ContinentCode: config.DummyContinentCode,
+			CountryCode:   config.DummyCountryCode,
+		}
+	}
+
+	record, err := geodb.City(getIP(h))
+	if err != nil {
+		return GeoLocation{ContinentCode: config.DefaultContinentCode}
+	}
+
+	location := GeoLocation{
+		ContinentCode: strings.ToLower(record.Continent.Code),
+		CountryCode:   strings.ToLower(record.Country.IsoCode),
+	}
+
+	if _, ok := config.Continents[location.ContinentCode]; !ok {
+		location.ContinentCode = config.DefaultContinentCode
+	}
+
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		location.HasCoordinates = true
+		location.Latitude = record.Location.Latitude
+		location.Longitude = record.Location.Longitude
+	}
+
+	return location
+}
+
+func geolocate(h HandlerArgs) (string, string, string, string, string, string, string, string) {
+	if appengine.IsDevAppServer() {
+		return config.DummyContinent,
+			config.DummyContinentCode,
+			config.DummyCountry,
+			config.DummyCountryCode,
+			config.DummyCity,
+			config.DummyPostalCode,
+			config.DummyAnalID,
+			config.DefaultFirebaseRegion
+	}
+
+	record, err := geodb.City(getIP(h))
+	if err != nil {
+		return config.DefaultContinent,
+			config.DefaultContinentCode,
+			"",
+			"",
+			"",
+			"",
+			"",
+			config.DefaultFirebaseRegion
+	}
+
+	language := config.DefaultLanguageCode
+	if val, ok := h.Vars["language"]; ok {
+		language = val
+	}
+
+	continent := ""
+	continentCode := strings.ToLower(record.Continent.Code)
+	if val, ok := record.Continent.Names[language]; ok {
+		continent = val
+	} else if val, ok := record.Continent.Names[config.DefaultLanguageCode]; ok {
+		continent = val
+	}
+
+	if _, ok := config.Continents[continentCode]; !ok {
+		continent = config.DefaultContinent
+		continentCode = config.DefaultContinentCode
+	}
+
+	country := ""
+	countryCode := strings.ToLower(record.Country.IsoCode)
+	if val, ok := record.Country.Names[language]; ok {
+		country = val
+	} else if val, ok := record.Country.Names[config.DefaultLanguageCode]; ok {
+		country = val
+	}
+
+	city := ""
+	if val, ok := record.City.Names[language]; ok {
+		city = val
+	} else if val, ok := record.City.Names[config.DefaultLanguageCode]; ok {
+		city = val
+	}
+
+	postalCode := record.Postal.Code
+
+	analID := analIDs[city]
+	if analID == "" {
+		analID = countryCode
+	}
+
+	firebaseRegion := config.DefaultFirebaseRegion
+	if val, ok := config.ContinentFirebaseRegions[continentCode]; ok {
+		firebaseRegion = val
+	}
+
+	return continent, continentCode, country, countryCode, city, postalCode, analID, firebaseRegion
+}
+
+func getProFeaturesFromRequest(h HandlerArgs) map[string]bool {
+	return map[string]bool{
+		"disableP2P":     sanitize(h.Request.PostFormValue("proFeatures[disableP2P]")) == "true",
+		"modestBranding": sanitize(h.Request.PostFormValue("proFeatures[modestBranding]")) == "true",
+		"nativeCrypto":   sanitize(h.Request.PostFormValue("proFeatures[nativeCrypto]")) == "true",
+		"telehealth":     sanitize(h.Request.PostFormValue("proFeatures[telehealth]")) == "true",
+		"video":          sanitize(h.Request.PostFormValue("proFeatures[video]")) == "true",
+		"voice":          sanitize(h.Request.PostFormValue("proFeatures[voice]")) == "true",
+	}
+}
+
+func getSignupFromRequest(h HandlerArgs) (BetaSignup, map[string]interface{}) {
+	_, _, country, countryCode, _, _, _, _ := geolocate(h)
+
+	signup := map[string]interface{}{}
+	profile := map[string]interface{}{}
+
+	usernameRequest := sanitize(h.Request.PostFormValue("usernameRequest"), config.MaxSignupValueLength)
+
+	betaSignup := BetaSignup{
+		Comment:         sanitize(h.Request.PostFormValue("comment"), config.MaxSignupValueLength),
+		Country:         country,
+		Email:           sanitize(strings.ToLower(h.Request.PostFormValue("email")), config.MaxSignupValueLength),
+		Invited:         false,
+		Language:        sanitize(h.Request.PostFormValue("language"), config.MaxSignupValueLength),
+		Name:            sanitize(h.Request.PostFormValue("name"), config.MaxSignupValueLength),
+		Referer:         sanitize(h.Request.Referer(), config.MaxSignupValueLength),
+		Time:            time.Now().Unix(),
+		UsernameRequest: usernameRequest,
+	}
+
+	profile["country"] = countryCode
+	profile["first_name"] = betaSignup.Name
+	profile["http_referrer"] = betaSignup.Referer
+	profile["locale"] = betaSignup.Language
+	profile["custom_var1"] = sanitize(h.Request.PostFormValue("inviteCode"), config.MaxSignupValueLength)
+	profile["custom_var2"] = sanitize(h.Request.PostFormValue("featureInterest"), config.MaxSignupValueLength)
+	profile["custom_var3"] = usernameRequest
+	signup["email"] = betaSignup.Email
+	signup["profile"] = profile
+
+	return betaSignup, signup
+}
+
+func getOrg(h HandlerArgs) string {
+	if appengine.IsDevAppServer() {
+		return config.DummyOrg
+	}
+
+	record, err := orgdb.ISP(getIP(h))
+	if err != nil {
+		return ""
+	}
+
+	return record.Organization
+}
+
+func getIP(h HandlerArgs) []byte {
+	return net.ParseIP(getIPString(h))
+}
+
+func getIPString(h HandlerArgs) string {
+	xff := h.Request.Header.Get("X-Forwarded-For")
+	if xff != "" {
+		return strings.Split(xff, ",")[0]
+	}
+
+	ip, _, _ := net.SplitHostPort(h.Request.RemoteAddr)
+	return ip
+}
+
+/* Reads cached health only; never blocks on the network */
+func getIPFSGateways(location GeoLocation, uptime IPFSGatewayUptimeData) []string {
+	backupContinentCode := config.DefaultContinentCode
+	if backupContinentCode == location.ContinentCode {
+		backupContinentCode = config.DefaultContinentCodeBackup
+	}
+
+	/* Nearby gateways come first, with the continent buckets kept after them for failover */
+	gateways := appendUniqueStrings(
+		getNearbyIPFSGateways(location, uptime),
+		getIPFSGatewaysInternal(location.ContinentCode, uptime, true),
+		getIPFSGatewaysInternal(backupContinentCode, uptime, true),
+	)
+
+	/* Before the first checks complete, or if everything is down, fall back to all gateways */
+	if len(gateways) < 1 {
+		gateways = appendUniqueStrings(
+			getIPFSGatewaysInternal(location.ContinentCode, uptime, false),
+			getIPFSGatewaysInternal(backupContinentCode, uptime, false),
+		)
+	}
+
+	return gateways
+}
+
+func appendUniqueStrings(lists ...[]string) []string {
+	o := []string{}
+	seen := map[string]bool{}
+
+	for _, list := range lists {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				o = append(o, s)
+			}
+		}
+	}
+
+	return o
+}
+
+/* Healthy gateways within config.IPFSGatewayMaxDistance of the client, ranked with a penalty for distance */
+func getNearbyIPFSGateways(location GeoLocation, uptime IPFSGatewayUptimeData) []string {
+	if !location.HasCoordinates && location.CountryCode == "" {
+		return []string{}
+	}
+
+	distances := map[string]float64{}
+	gatewayURLs := getIPFSGatewayURLs()
+
+	for i := range gatewayURLs {
+		gateway := gatewayURLs[i]
+		distance := math.Inf(1)
+
+		if gateway.HasCoordinates && location.HasCoordinates {
+			distance = getGreatCircleDistance(location.Latitude, location.Longitude, gateway.Latitude, gateway.Longitude)
+		} else if gateway.CountryCode != "" && gateway.CountryCode == location.CountryCode {
+			distance = 0
+		}
+
+		if previous, ok := distances[gateway.URL]; ok && previous <= distance {
+			continue
+		}
+		if distance <= config.IPFSGatewayMaxDistance {
+			distances[gateway.URL] = distance
+		}
+	}
+
+	candidates := []string{}
+	penalties := map[string]float64{}
+	for gateway, distance := range distances {
+		candidates = append(candidates, gateway)
+		penalties[gateway] = distance * config.IPFSGatewayDistancePenalty
+	}
+
+	return rankIPFSGateways(candidates, penalties, uptime, true)
+}
+
+/* Haversine distance in kilometers */
+func getGreatCircleDistance(latitudeA float64, longitudeA float64, latitudeB float64, longitudeB float64) float64 {
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+
+	deltaLatitude := toRadians(latitudeB - latitudeA)
+	deltaLongitude := toRadians(longitudeB - longitudeA)
+
+	a := math.Pow(math.Sin(deltaLatitude/2), 2) +
+		math.Cos(toRadians(latitudeA))*math.Cos(toRadians(latitudeB))*math.Pow(math.Sin(deltaLongitude/2), 2)
+
+	return 2 * 6371 * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func getIPFSGatewaysInternal(continentCode string, uptime IPFSGatewayUptimeData, healthyOnly bool) []string {
+	return rankIPFSGateways(getContinentIPFSGateways(continentCode), nil, uptime, healthyOnly)
+}
+
+/* Content that the monitor probes must be confirmed per gateway; anything else relies on overall gateway health */
+func rankIPFSGateways(allGateways []string, penalties map[string]float64, uptime IPFSGatewayUptimeData, healthyOnly bool) []string {
+	now := time.Now().Unix()
+
+	gateways := []string{}
+
+	scores := map[string]float64{}
+
+	ipfsGatewayUptimeChecks.RLock()
+
+	for i := range allGateways {
+		gateway := allGateways[i]
+		uptimeCheck, ok := ipfsGatewayUptimeChecks.checks[gateway]
+
+		if uptimeCheck.Drained {
+			continue
+		}
+
+		healthy := ok && uptimeCheck.Result && config.IPFSGatewayUptimeCheckTTL > (now-uptimeCheck.Timestamp)
+
+		if healthy && ipfsGatewayUptimeChecks.monitored[uptime.IPFSHash] {
+			contentCheck, ok := ipfsGatewayUptimeChecks.content[gateway][uptime.IPFSHash]
+			healthy = ok && contentCheck.Result && config.IPFSGatewayUptimeCheckTTL > (now-contentCheck.Timestamp)
+		}
+
+		if !healthyOnly || healthy {
+			gateways = append(gateways, gateway)
+			scores[gateway] = getIPFSGatewayScore(uptimeCheck, ok) + penalties[gateway]
+		}
+	}
+
+	ipfsGatewayUptimeChecks.RUnlock()
+
+	/* Shuffled first so that equally scored gateways share load */
+	nonSecureRandom.Shuffle(len(gateways), func(i, j int) {
+		gateways[i], gateways[j] = gateways[j], gateways[i]
+	})
+
+	sort.SliceStable(gateways, func(i, j int) bool {
+		return scores[gateways[i]] < scores[gateways[j]]
+	})
+
+	return gateways
+}
+
+/* Lower is better; gateways that have never succeeded rank last */
+func getIPFSGatewayScore(uptimeCheck IPFSGatewayUptimeCheckData, ok bool) float64 {
+	if !ok || uptimeCheck.Latency <= 0 {
+		return math.Inf(1)
+	}
+
+	return uptimeCheck.Latency + uptimeCheck.ErrorRate*config.IPFSGatewayErrorPenalty
+}
+
+func getIPFSGatewayMovingAverage(average float64, sample float64) float64 {
+	if average <= 0 {
+		return sample
+	}
+
+	return config.IPFSGatewayScoreDecay*sample + (1-config.IPFSGatewayScoreDecay)*average
+}
+
+func getIPFSGatewayUptimeCheck(gateway string) (IPFSGatewayUptimeCheckData, bool) {
+	ipfsGatewayUptimeChecks.RLock()
+	defer ipfsGatewayUptimeChecks.RUnlock()
+
+	uptimeCheck, ok := ipfsGatewayUptimeChecks.checks[gateway]
+	return uptimeCheck, ok
+}
+
+/* Runs for the lifetime of the instance */
+func monitorIPFSGateways() {
+	/* Without the datastore, each instance probes every gateway on its own */
+	h, err := newBackgroundHandlerArgs()
+	if err != nil {
+		log.Printf("Failed to share IPFS gateway health: %v", err)
+	}
+
+	checkAllIPFSGateways(h)
+
+	if h.Datastore != nil {
+		go refreshIPFSGatewayHealth(h)
+	}
+
+	ticker := time.NewTicker(ipfsGatewayMonitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkAllIPFSGateways(h)
+	}
+}
+
+/* Picks up results probed by other instances between this instance's own checks */
+func refreshIPFSGatewayHealth(h HandlerArgs) {
+	ticker := time.NewTicker(config.IPFSGatewayRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		gateways := []string{}
+		keys := []*datastore.Key{}
+		seen := map[string]bool{}
+
+		for _, gatewayURL := range getIPFSGatewayURLs() {
+			if seen[gatewayURL.URL] {
+				continue
+			}
+			seen[gatewayURL.URL] = true
+
+			gateways = append(gateways, gatewayURL.URL)
+			keys = append(keys, datastoreKey("IPFSGatewayHealth", gatewayURL.URL))
+		}
+
+		healths := make([]*IPFSGatewayHealth, len(keys))
+		for i := range healths {
+			healths[i] = &IPFSGatewayHealth{}
+		}
+
+		/* Gateways that no instance has probed yet have no health entity */
+		found := make([]bool, len(keys))
+		if err := h.Datastore.GetMulti(h.Context, keys, healths); err == nil {
+			for i := range found {
+				found[i] = true
+			}
+		} else if multiErr, ok := err.(datastore.MultiError); ok {
+			for i, err := range multiErr {
+				found[i] = err == nil
+			}
+		} else {
+			log.Printf("Failed to refresh IPFS gateway health: %v", err)
+			continue
+		}
+
+		for i, gateway := range gateways {
+			if found[i] {
+				mergeIPFSGatewayHealth(gateway, healths[i])
+			}
+		}
+	}
+}
+
+func checkAllIPFSGateways(h HandlerArgs) {
+	var wg sync.WaitGroup
+
+	gatewayURLs := getIPFSGatewayURLs()
+	uptimes := getMonitoredPackageUptimes()
+
+	ipfsGatewayUptimeChecks.Lock()
+	ipfsGatewayUptimeChecks.monitored = map[string]bool{}
+	for _, uptime := range uptimes {
+		ipfsGatewayUptimeChecks.monitored[uptime.IPFSHash] = true
+	}
+	ipfsGatewayUptimeChecks.Unlock()
+
+	checked := map[string]bool{}
+
+	for i := range gatewayURLs {
+		gateway := gatewayURLs[i].URL
+
+		if checked[gateway] {
+			continue
+		}
+		checked[gateway] = true
+
+		if uptimeCheck, ok := getIPFSGatewayUptimeCheck(gateway); ok && uptimeCheck.CircuitOpenUntil > time.Now().Unix() {
+			continue
+		}
+
+		jitter := time.Duration(nonSecureRandom.Int63n(int64(config.IPFSGatewayMonitorJitter) + 1))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(jitter)
+
+			if h.Datastore == nil {
+				checkIPFSGatewayPackages(gateway, uptimes)
+				return
+			}
+
+			acquired, err := acquireIPFSGatewayLease(h, gateway)
+			if err != nil {
+				log.Printf("Failed to lease IPFS gateway %s; checking anyway: %v", gateway, err)
+			} else if !acquired {
+				return
+			}
+
+			checkIPFSGatewayPackages(gateway, uptimes)
+
+			if err := saveIPFSGatewayHealth(h, gateway); err != nil {
+				log.Printf("Failed to save health of IPFS gateway %s: %v", gateway, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+/* Active content of every package, deduplicated by IPFS hash, with the default package first */
+func getMonitoredPackageUptimes() []IPFSGatewayUptimeData {
+	uptimes := []IPFSGatewayUptimeData{}
+	seen := map[string]bool{}
+
+	for _, packageName := range append([]string{config.DefaultPackage}, getPackageNames()...) {
+		packageData, ok := getCachedActivePackage(packageName)
+		if !ok || packageData.Uptime.IPFSHash == "" || seen[packageData.Uptime.IPFSHash] {
+			continue
+		}
+
+		seen[packageData.Uptime.IPFSHash] = true
+		uptimes = append(uptimes, packageData.Uptime)
+	}
+
+	return uptimes
+}
+
+/* Overall gateway health comes from the first (default package) probe; the rest only need to be served */
+func checkIPFSGatewayPackages(gateway string, uptimes []IPFSGatewayUptimeData) IPFSGatewayUptimeCheckData {
+	if len(uptimes) < 1 {
+		return recordIPFSGatewayCheck(gateway, 0, 0, nil)
+	}
+
+	latency, throughput, err := checkIPFSGateway(gateway, uptimes[0])
+	uptimeCheck := recordIPFSGatewayCheck(gateway, latency, throughput, err)
+	recordIPFSGatewayContentCheck(gateway, uptimes[0].IPFSHash, err)
+
+	for _, uptime := range uptimes[1:] {
+		if uptimeCheck.Result {
+			_, _, err = checkIPFSGateway(gateway, uptime)
+		}
+
+		recordIPFSGatewayContentCheck(gateway, uptime.IPFSHash, err)
+	}
+
+	return uptimeCheck
+}
+
+func recordIPFSGatewayContentCheck(gateway string, ipfsHash string, err error) {
+	ipfsGatewayUptimeChecks.Lock()
+	defer ipfsGatewayUptimeChecks.Unlock()
+
+	contentCheck := IPFSGatewayContentCheckData{
+		Result:    err == nil,
+		Timestamp: time.Now().Unix(),
+	}
+	if err != nil {
+		contentCheck.LastError = err.Error()
+	}
+
+	/* Replaced rather than mutated, so that checks of content no longer monitored are dropped */
+	contentChecks := map[string]IPFSGatewayContentCheckData{ipfsHash: contentCheck}
+	for k, v := range ipfsGatewayUptimeChecks.content[gateway] {
+		if k != ipfsHash && ipfsGatewayUptimeChecks.monitored[k] {
+			contentChecks[k] = v
+		}
+	}
+
+	ipfsGatewayUptimeChecks.content[gateway] = contentChecks
+}
+
+/* Keyed by package name, for active versions only */
+func getIPFSGatewayPackageChecks(gateway string) map[string]IPFSGatewayContentCheckData {
+	packageChecks := map[string]IPFSGatewayContentCheckData{}
+
+	packageNames := getPackageNames()
+	hashes := map[string]string{}
+	for _, packageName := range packageNames {
+		if packageData, ok := getCachedActivePackage(packageName); ok {
+			hashes[packageName] = packageData.Uptime.IPFSHash
+		}
+	}
+
+	ipfsGatewayUptimeChecks.RLock()
+	defer ipfsGatewayUptimeChecks.RUnlock()
+
+	for packageName, ipfsHash := range hashes {
+		if contentCheck, ok := ipfsGatewayUptimeChecks.content[gateway][ipfsHash]; ok {
+			packageChecks[packageName] = contentCheck
+		}
+	}
+
+	return packageChecks
+}
+
+/* Once the circuit opens, each further failure doubles how long the gateway is skipped */
+func recordIPFSGatewayCheck(gateway string, latency float64, throughput float64, err error) IPFSGatewayUptimeCheckData {
+	ipfsGatewayUptimeChecks.Lock()
+	defer ipfsGatewayUptimeChecks.Unlock()
+
+	now := time.Now().Unix()
+	uptimeCheck := ipfsGatewayUptimeChecks.checks[gateway]
+	result := err == nil
+
+	uptimeCheck.Result = result
+	uptimeCheck.Timestamp = now
+
+	if err != nil {
+		uptimeCheck.LastError = err.Error()
+	}
+
+	errorSample := 1.0
+	if result {
+		errorSample = 0
+	}
+
+	uptimeCheck.ErrorRate = config.IPFSGatewayScoreDecay*errorSample +
+		(1-config.IPFSGatewayScoreDecay)*uptimeCheck.ErrorRate
+
+	if result {
+		uptimeCheck.Latency = getIPFSGatewayMovingAverage(uptimeCheck.Latency, latency)
+		uptimeCheck.Throughput = getIPFSGatewayMovingAverage(uptimeCheck.Throughput, throughput)
+
+		uptimeCheck.CircuitOpenUntil = 0
+		uptimeCheck.ConsecutiveFailures = 0
+	} else {
+		uptimeCheck.ConsecutiveFailures++
+
+		if trips := uptimeCheck.ConsecutiveFailures - config.IPFSGatewayCircuitThreshold; trips >= 0 {
+			backoff := config.IPFSGatewayCircuitMaxBackoff
+			if trips < 30 {
+				backoff = int64(math.Min(
+					float64(config.IPFSGatewayCircuitBackoff)*math.Pow(2, float64(trips)),
+					float64(config.IPFSGatewayCircuitMaxBackoff),
+				))
+			}
+
+			uptimeCheck.CircuitOpenUntil = now + backoff
+		}
+	}
+
+	ipfsGatewayUptimeChecks.checks[gateway] = uptimeCheck
+
+	return uptimeCheck
+}
+
+/* Drained gateways are still checked, but never handed out; the datastore copy is what other instances follow */
+func setIPFSGatewayDrained(h HandlerArgs, gateway string, drained bool) IPFSGatewayUptimeCheckData {
+	key := datastoreKey("IPFSGatewayHealth", gateway)
+
+	_, err := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		health := &IPFSGatewayHealth{}
+		if err := datastoreTransaction.Get(key, health); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		health.UptimeCheck.Drained = drained
+		if !drained {
+			health.UptimeCheck.CircuitOpenUntil = 0
+		}
+
+		_, err := datastoreTransaction.Put(key, health)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to share drained state of IPFS gateway %s: %v", gateway, err)
+	}
+
+	ipfsGatewayUptimeChecks.Lock()
+	defer ipfsGatewayUptimeChecks.Unlock()
+
+	uptimeCheck := ipfsGatewayUptimeChecks.checks[gateway]
+	uptimeCheck.Drained = drained
+
+	if !drained {
+		uptimeCheck.CircuitOpenUntil = 0
+	}
+
+	ipfsGatewayUptimeChecks.checks[gateway] = uptimeCheck
+
+	return uptimeCheck
+}
+
+/* For background work outside of a request; only Context and Datastore are set */
+func newBackgroundHandlerArgs() (HandlerArgs, error) {
+	ctx := context.Background()
+
+	datastoreClient, err := datastore.NewClient(ctx, getDatastoreProjectID())
+	if err != nil {
+		return HandlerArgs{}, err
+	}
+
+	return HandlerArgs{Context: ctx, Datastore: datastoreClient}, nil
+}
+
+func getDatastoreProjectID() string {
+	if appengine.IsDevAppServer() {
+		return "test"
+	}
+
+	return datastore.DetectProjectID
+}
+
+/* Returns whether this instance should probe the gateway; if not, adopts the latest shared results instead */
+func acquireIPFSGatewayLease(h HandlerArgs, gateway string) (bool, error) {
+	key := datastoreKey("IPFSGatewayHealth", gateway)
+	acquired := false
+	found := false
+	health := &IPFSGatewayHealth{}
+
+	_, err := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		now := time.Now().Unix()
+		acquired = false
+		found = false
+		health = &IPFSGatewayHealth{}
+
+		err := datastoreTransaction.Get(key, health)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		found = err == nil
+
+		/* Skip gateways that another instance is probing or has just probed */
+		if found && ((health.LeaseExpires > now && health.LeaseHolder != instanceID) ||
+			health.UptimeCheck.Timestamp > now-int64(ipfsGatewayMonitorInterval.Seconds()/2)) {
+			return nil
+		}
+
+		lease := *health
+		lease.LeaseExpires = now + config.IPFSGatewayLeaseDuration
+		lease.LeaseHolder = instanceID
+
+		_, err = datastoreTransaction.Put(key, &lease)
+		acquired = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		mergeIPFSGatewayHealth(gateway, health)
+	}
+
+	return acquired, nil
+}
+
+/* Newer shared results replace local ones; the shared drained state always wins */
+func mergeIPFSGatewayHealth(gateway string, health *IPFSGatewayHealth) {
+	contentChecks := map[string]IPFSGatewayContentCheckData{}
+	if len(health.Content) > 0 {
+		if err := json.Unmarshal(health.Content, &contentChecks); err != nil {
+			log.Printf("Ignoring malformed content checks of IPFS gateway %s: %v", gateway, err)
+		}
+	}
+
+	ipfsGatewayUptimeChecks.Lock()
+	defer ipfsGatewayUptimeChecks.Unlock()
+
+	uptimeCheck := ipfsGatewayUptimeChecks.checks[gateway]
+
+	if health.UptimeCheck.Timestamp > uptimeCheck.Timestamp {
+		uptimeCheck = health.UptimeCheck
+		ipfsGatewayUptimeChecks.content[gateway] = contentChecks
+	}
+
+	uptimeCheck.Drained = health.UptimeCheck.Drained
+
+	ipfsGatewayUptimeChecks.checks[gateway] = uptimeCheck
+}
+
+/* Publishes this instance's results and releases the lease */
+func saveIPFSGatewayHealth(h HandlerArgs, gateway string) error {
+	key := datastoreKey("IPFSGatewayHealth", gateway)
+
+	ipfsGatewayUptimeChecks.RLock()
+	uptimeCheck := ipfsGatewayUptimeChecks.checks[gateway]
+	content, err := json.Marshal(ipfsGatewayUptimeChecks.content[gateway])
+	ipfsGatewayUptimeChecks.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		health := &IPFSGatewayHealth{}
+		err := datastoreTransaction.Get(key, health)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		/* An admin may have drained or enabled the gateway mid-check */
+		if err == nil {
+			uptimeCheck.Drained = health.UptimeCheck.Drained
+		}
+
+		_, err = datastoreTransaction.Put(key, &IPFSGatewayHealth{
+			Content:     content,
+			UptimeCheck: uptimeCheck,
+		})
+		return err
+	})
+
+	return err
+}
+
+func getIPFSGatewayData(gateway string) (IPFSGatewayData, bool) {
+	gatewayURLs := getIPFSGatewayURLs()
+
+	for i := range gatewayURLs {
+		if gatewayURLs[i].URL == gateway {
+			return gatewayURLs[i], true
+		}
+	}
+
+	return IPFSGatewayData{}, false
+}
+
+/* Shared by the admin gateway endpoints */
+func updateIPFSGateway(h HandlerArgs, f func(gateway string) IPFSGatewayUptimeCheckData) (interface{}, int) {
+	if sanitize(h.Request.PostFormValue("cyphAdminKey")) != cyphAdminKey {
+		return "", http.StatusForbidden
+	}
+
+	gateway, ok := getIPFSGatewayData(h.Request.PostFormValue("gateway"))
+	if !ok {
+		return "gateway not found", http.StatusNotFound
+	}
+
+	return getIPFSGatewayStatus(gateway, f(gateway.URL)), http.StatusOK
+}
+
+func getIPFSGatewayStatus(gateway IPFSGatewayData, uptimeCheck IPFSGatewayUptimeCheckData) map[string]interface{} {
+	packages := map[string]interface{}{}
+	for packageName, contentCheck := range getIPFSGatewayPackageChecks(gateway.URL) {
+		packages[packageName] = map[string]interface{}{
+			"lastChecked": contentCheck.Timestamp,
+			"lastError":   contentCheck.LastError,
+			"result":      contentCheck.Result,
+		}
+	}
+
+	return map[string]interface{}{
+		"circuitOpenUntil":    uptimeCheck.CircuitOpenUntil,
+		"consecutiveFailures": uptimeCheck.ConsecutiveFailures,
+		"continentCode":       gateway.ContinentCode,
+		"countryCode":         gateway.CountryCode,
+		"drained":             uptimeCheck.Drained,
+		"errorRate":           uptimeCheck.ErrorRate,
+		"lastChecked":         uptimeCheck.Timestamp,
+		"lastError":           uptimeCheck.LastError,
+		"latency":             uptimeCheck.Latency,
+		"latitude":            gateway.Latitude,
+		"longitude":           gateway.Longitude,
+		"packages":            packages,
+		"result":              uptimeCheck.Result,
+		"throughput":          uptimeCheck.Throughput,
+		"url":                 gateway.URL,
+	}
+}
+
+/* Passes on the first try within the deadline whose content matches the integrity hash; wrong content fails at once, other errors are retried */
+func checkIPFSGateway(gateway string, uptime IPFSGatewayUptimeData) (float64, float64, error) {
+	if uptime.IPFSHash == "" {
+		return 0, 0, nil
+	}
+
+	newHash, digest, err := parseIntegrityHash(uptime.IntegrityHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.IPFSGatewayUptimeCheckDeadline)
+	defer cancel()
+
+	client := &http.Client{
+		Timeout: config.IPFSGatewayUptimeCheckTimeout,
+	}
+
+	gatewayURL := strings.Replace(gateway, ":hash", uptime.IPFSHash, 1)
+
+	for i := 0; i < config.IPFSGatewayUptimeCheckTries && ctx.Err() == nil; i++ {
+		start := time.Now()
+
+		var n int64
+		n, err = fetchIPFSGatewayContent(ctx, client, gatewayURL, newHash(), digest)
+
+		/* Wrong content won't fix itself on a retry */
+		if err == errIPFSGatewayIntegrity {
+			return 0, 0, err
+		}
+		if err != nil {
+			continue
+		}
+
+		/* Latency in milliseconds and throughput in bytes per second of the passing try */
+		elapsed := time.Since(start)
+
+		return float64(elapsed.Milliseconds()),
+			float64(n) / math.Max(elapsed.Seconds(), 0.001),
+			nil
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return 0, 0, err
+}
+
+/* Streams the response through the hasher, so memory use doesn't depend on the size of the content */
+func fetchIPFSGatewayContent(ctx context.Context, client *http.Client, gatewayURL string, hasher hash.Hash, digest []byte) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, methods.GET, gatewayURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected response (status %d)", resp.StatusCode)
+	}
+
+	n, err := io.Copy(hasher, io.LimitReader(resp.Body, config.IPFSGatewayUptimeCheckMaxSize+1))
+	if err != nil {
+		return n, err
+	}
+	if n > config.IPFSGatewayUptimeCheckMaxSize {
+		return n, fmt.Errorf("response exceeds %d bytes", config.IPFSGatewayUptimeCheckMaxSize)
+	}
+
+	if subtle.ConstantTimeCompare(hasher.Sum(nil), digest) != 1 {
+		return n, errIPFSGatewayIntegrity
+	}
+
+	return n, nil
+}
+
+/* Integrity hashes use the subresource integrity format, e.g. "sha512-<base64 digest>" */
+func parseIntegrityHash(integrityHash string) (func() hash.Hash, []byte, error) {
+	hashData := strings.SplitN(integrityHash, "-", 2)
+	if len(hashData) != 2 {
+		return nil, nil, fmt.Errorf("malformed integrity hash %q", integrityHash)
+	}
+
+	var newHash func() hash.Hash
+	switch hashData[0] {
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported integrity hash algorithm %q", hashData[0])
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(hashData[1])
+	if err != nil || len(digest) != newHash().Size() {
+		return nil, nil, fmt.Errorf("malformed integrity hash %q", integrityHash)
+	}
+
+	return newHash, digest, nil
+}
+
+func braintreeDecimalToCents(d *braintree.Decimal) int64 {
+	if d.Scale == 2 {
+		return d.Unscaled
+	}
+
+	return int64(float64(d.Unscaled) / math.Pow10(d.Scale-2))
+}
+
+func braintreeInit(h HandlerArgs) *braintree.Braintree {
+	env := braintree.Sandbox
+
+	if isProd {
+		env = braintree.Production
+	}
+
+	bt := braintree.New(
+		env,
+		braintreeMerchantID,
+		braintreePublicKey,
+		braintreePrivateKey,
+	)
+
+	bt.HttpClient = &http.Client{}
+
+	return bt
+}
+
+func downgradeAccountHelper(userToken string, removeAppStoreReceiptRef bool) (string, string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"namespace":                "cyph.ws",
+		"removeAppStoreReceiptRef": removeAppStoreReceiptRef,
+		"userToken":                userToken,
+	})
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest(
+		methods.POST,
+		firebaseFunctionURL+"downgradeAccount",
+		bytes.NewBuffer(body),
+	)
+
+	req.Header.Add("Authorization", cyphFirebaseAdminKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	if err != nil {
+		return "", "", err
+	}
+
+	appStoreReceipt := ""
+	if data, ok := responseBody["appStoreReceipt"]; ok {
+		switch v := data.(type) {
+		case string:
+			appStoreReceipt = v
+		}
+	}
+
+	braintreeSubscriptionID := ""
+	if data, ok := responseBody["braintreeSubscriptionID"]; ok {
+		switch v := data.(type) {
+		case string:
+			braintreeSubscriptionID = v
+		}
+	}
+
+	return appStoreReceipt, braintreeSubscriptionID, nil
+}
+
+func generateInvite(email, name, plan, appStoreReceipt string, braintreeIDs, braintreeSubscriptionIDs []string, inviteCode, username string, giftPack, purchased bool) (string, string, string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"appStoreReceipt":          appStoreReceipt,
+		"braintreeIDs":             strings.Join(braintreeIDs, "\n"),
+		"braintreeSubscriptionIDs": strings.Join(braintreeSubscriptionIDs, "\n"),
+		"email":                    email,
+		"giftPack":                 giftPack,
+		"inviteCode":               inviteCode,
+		"name":                     name,
+		"namespace":                "cyph.ws",
+		"plan":                     plan,
+		"purchased":                purchased,
+		"username":                 username,
+	})
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest(
+		methods.POST,
+		firebaseFunctionURL+"generateInvite",
+		bytes.NewBuffer(body),
+	)
+
+	req.Header.Add("Authorization", cyphFirebaseAdminKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if data, ok := responseBody["inviteCode"]; ok {
+		switch v := data.(type) {
+		case string:
+			inviteCode = v
+		}
+	}
+
+	oldBraintreeSubscriptionID := ""
+	if data, ok := responseBody["oldBraintreeSubscriptionID"]; ok {
+		switch v := data.(type) {
+		case string:
+			oldBraintreeSubscriptionID = v
+		}
+	}
+
+	welcomeLetter := ""
+	if data, ok := responseBody["welcomeLetter"]; ok {
+		switch v := data.(type) {
+		case string:
+			welcomeLetter = v
+		}
+	}
+
+	return inviteCode, oldBraintreeSubscriptionID, welcomeLetter, nil
+}
+
+func getBraintreeSubscriptionID(userToken string) (string, string, int64, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"namespace": "cyph.ws",
+		"userToken": userToken,
+	})
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest(
+		methods.POST,
+		firebaseFunctionURL+"getBraintreeSubscriptionID",
+		bytes.NewBuffer(body),
+	)
+
+	req.Header.Add("Authorization", cyphFirebaseAdminKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	appStoreReceipt := ""
+	if data, ok := responseBody["appStoreReceipt"]; ok {
+		switch v := data.(type) {
+		case string:
+			appStoreReceipt = v
+		}
+	}
+
+	braintreeSubscriptionID := ""
+	if data, ok := responseBody["braintreeSubscriptionID"]; ok {
+		switch v := data.(type) {
+		case string:
+			braintreeSubscriptionID = v
+		}
+	}
+
+	planTrialEnd := int64(0)
+	if data, ok := responseBody["planTrialEnd"]; ok {
+		switch v := data.(type) {
+		case float64:
+			planTrialEnd = int64(v)
+		}
+	}
+
+	return appStoreReceipt, braintreeSubscriptionID, planTrialEnd, nil
+}
+
+func getUsername(userToken string) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"namespace": "cyph.ws",
+		"userToken": userToken,
+	})
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest(
+		methods.POST,
+		firebaseFunctionURL+"openUserToken",
+		bytes.NewBuffer(body),
+	)
+
+	req.Header.Add("Authorization", cyphFirebaseAdminKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	if err != nil {
+		return "", err
+	}
+
+	username := ""
+	if data, ok := responseBody["username"]; ok {
+		switch v := data.(type) {
+		case string:
+			username = v
+		}
+	}
+
+	return username, nil
+}
+
+func getCustomer(h HandlerArgs) (*Customer, *datastore.Key, error) {
+	var apiKey string
+	if authHeader, ok := h.Request.Header["Authorization"]; ok && len(authHeader) > 0 {
+		apiKey = authHeader[0]
+	} else {
+		return nil, nil, errors.New("must include an API key")
+	}
+
+	customer := &Customer{}
+	customerKey := datastoreKey("Customer", apiKey)
+
+	if err := h.Datastore.Get(h.Context, customerKey, customer); err != nil {
+		return nil, nil, errors.New("invalid API key")
+	}
+
+	return customer, customerKey, nil
+}
+
+func getAppStoreTransactionDataInternal(appStoreReceipt string, sandbox bool) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"password":     appStoreSecret,
+		"receipt-data": appStoreReceipt,
+	})
+
+	client := &http.Client{}
+
+	url := "https://buy.itunes.apple.com/verifyReceipt"
+	if sandbox {
+		url = "https://sandbox.itunes.apple.com/verifyReceipt"
+	}
+
+	req, _ := http.NewRequest(
+		methods.POST,
+		url,
+		bytes.NewBuffer(body),
+	)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	if err != nil {
+		return "", err
+	}
+
+	status := int64(-1)
+	if data, ok := responseBody["status"]; ok {
+		switch v := data.(type) {
+		case float64:
+			status = int64(v)
+		}
+	}
+
+	if !sandbox && status == 21007 {
+		return getAppStoreTransactionDataInternal(appStoreReceipt, true)
+	}
+
+	if status != 0 {
+		return "", errors.New("Error status: " + string(status))
+	}
+
+	receiptData := map[string]interface{}{}
+	if data, ok := responseBody["receipt"]; ok {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			receiptData = v
+		}
+	}
+
+	inAppData := map[string]interface{}{}
+	if data, ok := receiptData["in_app"]; ok {
+		switch v := data.(type) {
+		case []interface{}:
+			if len(v) > 0 {
+				o := v[len(v)-1]
+				switch value := o.(type) {
+				case map[string]interface{}:
+					inAppData = value
+				}
+			}
+		}
+	}
+
+	productID := ""
+	if data, ok := inAppData["product_id"]; ok {
+		switch v := data.(type) {
+		case string:
+			productID = v
+		}
+	}
+
+	planID, ok := config.PlanAppleIDs[productID]
+	if !ok {
+		return "", errors.New("Invalid data from App Store receipt: " + string(responseBodyBytes))
+	}
+
+	return planID, nil
+}
+
+func getAppStoreTransactionData(appStoreReceipt string) (string, error) {
+	return getAppStoreTransactionDataInternal(appStoreReceipt, false)
+}
+
+func getBitPayInvoice(id string) (map[string]interface{}, error) {
+	client := &http.Client{}
+
+	req, _ := http.NewRequest(
+		methods.GET,
+		"https://bitpay.com/invoices/"+id+"?token="+config.BitPayToken,
+		nil,
+	)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var body map[string]interface{}
+	err = json.Unmarshal(jsonBody, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, ok := body["data"]; ok {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			return v, nil
+		}
+	}
+
+	return nil, errors.New("invalid invoice ID: " + id)
+}
+
+func redoxEncrypt(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func redoxDecrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("invalid Redox ciphertext")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+/* Encrypts fields in place under a new data key, wrapped with the current key-encryption key */
+func sealRedoxFields(fields ...*string) ([]byte, string, error) {
+	keyEncryptionKey, ok := redoxKeyEncryptionKeys.Keys[redoxKeyEncryptionKeys.CurrentID]
+	if !ok {
+		return nil, "", errors.New("Redox key-encryption key not configured")
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	encryptedDataKey, err := redoxEncrypt(keyEncryptionKey, dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+
+		ciphertext, err := redoxEncrypt(dataKey, []byte(*field))
+		if err != nil {
+			return nil, "", err
+		}
+
+		*field = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	return encryptedDataKey, redoxKeyEncryptionKeys.CurrentID, nil
+}
+
+/* Rows written before encryption at rest have no data key and are left as-is */
+func openRedoxFields(encryptedDataKey []byte, keyEncryptionKeyID string, fields ...*string) error {
+	if len(encryptedDataKey) < 1 {
+		return nil
+	}
+
+	keyEncryptionKey, ok := redoxKeyEncryptionKeys.Keys[keyEncryptionKeyID]
+	if !ok {
+		return errors.New("unknown Redox key-encryption key: " + keyEncryptionKeyID)
+	}
+
+	dataKey, err := redoxDecrypt(keyEncryptionKey, encryptedDataKey)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(*field)
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := redoxDecrypt(dataKey, ciphertext)
+		if err != nil {
+			return err
+		}
+
+		*field = string(plaintext)
+	}
+
+	return nil
+}
+
+func encryptRedoxAuth(redoxAuth *RedoxAuth) (*RedoxAuth, error) {
+	encryptedRedoxAuth := *redoxAuth
+
+	encryptedDataKey, keyEncryptionKeyID, err := sealRedoxFields(
+		&encryptedRedoxAuth.AccessToken,
+		&encryptedRedoxAuth.RefreshToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedRedoxAuth.EncryptedDataKey = encryptedDataKey
+	encryptedRedoxAuth.KeyEncryptionKeyID = keyEncryptionKeyID
+
+	return &encryptedRedoxAuth, nil
+}
+
+func encryptRedoxEvent(redoxEvent *RedoxEvent) (*RedoxEvent, error) {
+	encryptedRedoxEvent := *redoxEvent
+
+	encryptedDataKey, keyEncryptionKeyID, err := sealRedoxFields(&encryptedRedoxEvent.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedRedoxEvent.EncryptedDataKey = encryptedDataKey
+	encryptedRedoxEvent.KeyEncryptionKeyID = keyEncryptionKeyID
+
+	return &encryptedRedoxEvent, nil
+}
+
+func decryptRedoxEvent(redoxEvent *RedoxEvent) error {
+	return openRedoxFields(redoxEvent.EncryptedDataKey, redoxEvent.KeyEncryptionKeyID, &redoxEvent.Payload)
+}
+
+func decryptRedoxAuth(redoxAuth *RedoxAuth) error {
+	err := openRedoxFields(
+		redoxAuth.EncryptedDataKey,
+		redoxAuth.KeyEncryptionKeyID,
+		&redoxAuth.AccessToken,
+		&redoxAuth.RefreshToken,
+	)
+	if err != nil {
+		return err
+	}
+
+	redoxAuth.EncryptedDataKey = nil
+	redoxAuth.KeyEncryptionKeyID = ""
+
+	return nil
+}
+
+func encryptRedoxCredentials(redoxCredentials *RedoxCredentials) (*RedoxCredentials, error) {
+	encryptedRedoxCredentials := *redoxCredentials
+
+	if encryptedRedoxCredentials.RedoxSecret == "" {
+		return &encryptedRedoxCredentials, nil
+	}
+
+	encryptedDataKey, keyEncryptionKeyID, err := sealRedoxFields(&encryptedRedoxCredentials.RedoxSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedRedoxCredentials.EncryptedDataKey = encryptedDataKey
+	encryptedRedoxCredentials.KeyEncryptionKeyID = keyEncryptionKeyID
+
+	return &encryptedRedoxCredentials, nil
+}
+
+func decryptRedoxCredentials(redoxCredentials *RedoxCredentials) error {
+	err := openRedoxFields(
+		redoxCredentials.EncryptedDataKey,
+		redoxCredentials.KeyEncryptionKeyID,
+		&redoxCredentials.RedoxSecret,
+	)
+	if err != nil {
+		return err
+	}
+
+	redoxCredentials.EncryptedDataKey = nil
+	redoxCredentials.KeyEncryptionKeyID = ""
+
+	return nil
+}
+
+/* Order in which redoxReencrypt works through the encrypted kinds */
+var redoxReencryptKinds = []string{"RedoxCredentials", "RedoxAuth", "RedoxEvent"}
+
+/* Re-reads an entity inside the transaction; returns a nil entity if it is already under the current key */
+func reencryptRedoxEntity(datastoreTransaction *datastore.Transaction, kind string, key *datastore.Key) (interface{}, error) {
+	switch kind {
+	case "RedoxAuth":
+		redoxAuth := &RedoxAuth{}
+		err := datastoreTransaction.Get(key, redoxAuth)
+		if err != nil || redoxAuth.KeyEncryptionKeyID == redoxKeyEncryptionKeys.CurrentID {
+			return nil, err
+		}
+
+		if err = decryptRedoxAuth(redoxAuth); err != nil {
+			return nil, err
+		}
+
+		return encryptRedoxAuth(redoxAuth)
+
+	case "RedoxCredentials":
+		redoxCredentials := &RedoxCredentials{}
+		err := datastoreTransaction.Get(key, redoxCredentials)
+		if err != nil ||
+			redoxCredentials.RedoxSecret == "" ||
+			redoxCredentials.KeyEncryptionKeyID == redoxKeyEncryptionKeys.CurrentID {
+			return nil, err
+		}
+
+		if err = decryptRedoxCredentials(redoxCredentials); err != nil {
+			return nil, err
+		}
+
+		return encryptRedoxCredentials(redoxCredentials)
+
+	case "RedoxEvent":
+		redoxEvent := &RedoxEvent{}
+		err := datastoreTransaction.Get(key, redoxEvent)
+		if err != nil || redoxEvent.KeyEncryptionKeyID == redoxKeyEncryptionKeys.CurrentID {
+			return nil, err
+		}
+
+		if err = decryptRedoxEvent(redoxEvent); err != nil {
+			return nil, err
+		}
+
+		return encryptRedoxEvent(redoxEvent)
+	}
+
+	return nil, fmt.Errorf("unsupported kind %s", kind)
+}
+
+/* Updates that land between the page query and the write make the transaction retry against the new data */
+func reencryptRedoxEntityBatch(h HandlerArgs, kind string, keys []*datastore.Key) (int, error) {
+	count := 0
+
+	_, err := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		count = 0
+
+		for _, key := range keys {
+			entity, err := reencryptRedoxEntity(datastoreTransaction, kind, key)
+
+			/* Deleted since the page was read */
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if entity == nil {
+				continue
+			}
+
+			if _, err := datastoreTransaction.Put(key, entity); err != nil {
+				return err
+			}
+
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+/* Works through kind a page at a time until done or the deadline passes; returns the cursor to resume from */
+func reencryptRedoxEntities(h HandlerArgs, kind string, cursorString string, deadline time.Time) (int, string, bool, error) {
+	count := 0
+
+	for time.Now().Before(deadline) {
+		query := datastoreQuery(kind).KeysOnly().Limit(config.ExpiredEntityCleanupBatchSize)
+
+		if cursorString != "" {
+			cursor, err := datastore.DecodeCursor(cursorString)
+			if err != nil {
+				return count, "", false, err
+			}
+
+			query = query.Start(cursor)
+		}
+
+		it := h.Datastore.Run(h.Context, query)
+		keys := []*datastore.Key{}
+
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return count, cursorString, false, err
+			}
+
+			keys = append(keys, key)
+		}
+
+		/* Stopping partway through a page resumes from its start; entities already done are skipped */
+		for i := 0; i < len(keys); i += config.RedoxReencryptTransactionSize {
+			if !time.Now().Before(deadline) {
+				return count, cursorString, false, nil
+			}
+
+			end := i + config.RedoxReencryptTransactionSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			batchCount, err := reencryptRedoxEntityBatch(h, kind, keys[i:end])
+			count += batchCount
+			if err != nil {
+				return count, cursorString, false, err
+			}
+		}
+
+		if len(keys) < config.ExpiredEntityCleanupBatchSize {
+			return count, "", true, nil
+		}
+
+		cursor, err := it.Cursor()
+		if err != nil {
+			return count, cursorString, false, err
+		}
+
+		cursorString = cursor.String()
+	}
+
+	return count, cursorString, false, nil
+}
+
+func requestRedoxAuth(path string, body map[string]string) (*RedoxAuth, error) {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(
+		methods.POST,
+		redoxBaseURL+"/auth/"+path,
+		bytes.NewBuffer(requestBody),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseBody map[string]interface{}
+	err = json.Unmarshal(jsonBody, &responseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	redoxAuth := &RedoxAuth{}
+
+	if data, ok := responseBody["accessToken"]; ok {
+		switch v := data.(type) {
+		case string:
+			redoxAuth.AccessToken = v
+		}
+	}
+
+	if data, ok := responseBody["expires"]; ok {
+		switch v := data.(type) {
+		case string:
+			expiryTimestamp, _ := time.Parse(time.RFC3339, v)
+			redoxAuth.Expires = expiryTimestamp.UnixNano() / 1e6
+		}
+	}
+
+	if data, ok := responseBody["refreshToken"]; ok {
+		switch v := data.(type) {
+		case string:
+			redoxAuth.RefreshToken = v
+		}
+	}
+
+	if redoxAuth.AccessToken == "" || redoxAuth.Expires == 0 || redoxAuth.RefreshToken == "" {
+		return nil, errors.New("invalid Redox auth data")
+	}
+
+	return redoxAuth, nil
+}
+
+/* Shared by /redox/execute and the FHIR facade */
+func runRedoxCommand(h HandlerArgs, apiKeyOrMasterAPIKey string, redoxCommand string) (interface{}, int) {
+	/* Get Redox API credentials */
+
+	timestamp := getTimestamp()
+
+	redoxCredentials := &RedoxCredentials{}
+
+	err := h.Datastore.Get(
+		h.Context,
+		datastoreKey("RedoxCredentials", apiKeyOrMasterAPIKey),
+		redoxCredentials,
+	)
+
+	if err != nil {
+		return "invalid API key", http.StatusNotFound
+	}
+
+	username := redoxCredentials.Username
+
+	masterAPIKey := redoxCredentials.MasterAPIKey
+	if masterAPIKey == "" {
+		masterAPIKey = apiKeyOrMasterAPIKey
+	}
+
+	/* Reject malformed commands before they consume Redox quota or reach the request log */
+	if validationErrors := validateRedoxCommand(redoxCommand); len(validationErrors) > 0 {
+		return map[string]interface{}{"errors": validationErrors}, http.StatusBadRequest
+	}
+
+	/* Restrictions apply to child keys only; checked before master credentials are loaded */
+	if redoxCredentials.Disabled {
+		return "disabled API key", http.StatusForbidden
+	}
+
+	dataModel, eventType := getRedoxCommandMetadata(redoxCommand)
+
+	if !isRedoxDataModelAllowed(redoxCredentials, dataModel) {
+		return "data model not allowed for API key", http.StatusForbidden
+	}
+
+	apiKeyCredentials := *redoxCredentials
+
+	if redoxCredentials.RedoxAPIKey == "" || redoxCredentials.RedoxSecret == "" {
+		if redoxCredentials.MasterAPIKey == "" {
+			return "retired API key", http.StatusNotFound
+		}
+
+		err := h.Datastore.Get(
+			h.Context,
+			datastoreKey("RedoxCredentials", redoxCredentials.MasterAPIKey),
+			redoxCredentials,
+		)
+
+		if err != nil {
+			return err.Error(), http.StatusInternalServerError
+		}
+
+		if redoxCredentials.RedoxAPIKey == "" || redoxCredentials.RedoxSecret == "" {
+			return "redox credentials not found", http.StatusInternalServerError
+		}
+	}
+
+	/* Child key calls count against both the child's and the master key's limits */
+
+	limitedCredentials := []*RedoxCredentials{redoxCredentials}
+	if apiKeyCredentials.MasterAPIKey != "" {
+		limitedCredentials = append(limitedCredentials, &apiKeyCredentials)
+	}
+
+	if retryAfter, err := consumeRedoxUsage(h, limitedCredentials); err == errRedoxRateLimited {
+		h.Writer.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		return err.Error(), http.StatusTooManyRequests
+	} else if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	if err := decryptRedoxCredentials(redoxCredentials); err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	/* Get Redox API auth token */
+
+	redoxAuth, err := getRedoxAuth(h, redoxCredentials)
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	/* Make and log request */
+
+	req, err := http.NewRequest(
+		methods.POST,
+		redoxBaseURL+"/query",
+		bytes.NewBuffer([]byte(redoxCommand)),
+	)
+
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	req.Header.Add("Authorization", "Bearer "+redoxAuth.AccessToken)
+	req.Header.Add("Content-type", "application/json")
+
+	requestTimestamp := getTimestamp()
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	/* Token was revoked or expired early; force a refresh on the next call */
+	if resp.StatusCode == http.StatusUnauthorized {
+		invalidateRedoxAuth(redoxCredentials.RedoxAPIKey)
+	}
+
+	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error(), http.StatusInternalServerError
+	}
+
+	responseBody := string(responseBodyBytes)
+
+	redoxRequestLog := &RedoxRequestLog{
+		DataModel:    dataModel,
+		EventType:    eventType,
+		Latency:      getTimestamp() - requestTimestamp,
+		MasterAPIKey: masterAPIKey,
+		Status:       resp.StatusCode,
+		Timestamp:    timestamp,
+		Username:     username,
+	}
+
+	if !config.RedoxRequestLogMetadataOnly {
+		redactedRedoxCommand, commandOK := redactRedoxJSON(redoxCommand)
+		redactedResponse, responseOK := redactRedoxJSON(responseBody)
+
+		if commandOK && responseOK {
+			redoxRequestLog.RedoxCommand = sanitize(redactedRedoxCommand)
+			redoxRequestLog.Response = sanitize(redactedResponse)
+		}
+	}
+
+	h.Datastore.Put(
+		h.Context,
+		datastoreKey(
+			"RedoxRequestLog",
+			getRedoxRequestLogKeyName(masterAPIKey, username, timestamp)+generateRandomID(),
+		),
+		redoxRequestLog,
+	)
+
+	return responseBody, http.StatusOK
+}
+
+/* Zero falls back to the default; negative disables the limit */
+func getRedoxLimit(limit int64, defaultLimit int64) int64 {
+	if limit == 0 {
+		return defaultLimit
+	}
+
+	return limit
+}
+
+/* Applies any limits present in the request */
+func setRedoxLimits(h HandlerArgs, redoxCredentials *RedoxCredentials) error {
+	for _, limit := range []struct {
+		name  string
+		value *int64
+	}{
+		{"dailyQuota", &redoxCredentials.DailyQuota},
+		{"rateLimit", &redoxCredentials.RateLimit},
+		{"rateLimitBurst", &redoxCredentials.RateLimitBurst},
+	} {
+		if _, ok := h.Request.PostForm[limit.name]; !ok {
+			continue
+		}
+
+		value, err := strconv.ParseInt(sanitize(h.Request.PostFormValue(limit.name)), 10, 64)
+		if err != nil || value < -1 {
+			return errors.New("invalid " + limit.name + " value")
+		}
+
+		*limit.value = value
+	}
+
+	return nil
+}
+
+/* Master keys absorb every child key's calls, so their usage is sharded; shard 0 is the original entity */
+func getRedoxUsageKeys(redoxCredentials *RedoxCredentials) []*datastore.Key {
+	keys := []*datastore.Key{datastoreKey("RedoxUsage", redoxCredentials.APIKey)}
+
+	if redoxCredentials.MasterAPIKey != "" {
+		return keys
+	}
+
+	for i := 1; i < config.RedoxMasterUsageShards; i++ {
+		keys = append(keys, datastoreKey("RedoxUsage", fmt.Sprintf("%s:%d", redoxCredentials.APIKey, i)))
+	}
+
+	return keys
+}
+
+/* Each shard enforces its share of the rate limit, so no shard is given less than one call of burst */
+func getRedoxUsageShardCount(redoxCredentials *RedoxCredentials) int {
+	shardCount := len(getRedoxUsageKeys(redoxCredentials))
+
+	rateLimitBurst := getRedoxLimit(redoxCredentials.RateLimitBurst, config.RedoxDefaultRateLimitBurst)
+	if rateLimitBurst > 0 && int64(shardCount) > rateLimitBurst {
+		shardCount = int(rateLimitBurst)
+	}
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	return shardCount
+}
+
+/* Usage entities are created on first use, so missing ones read as zero */
+func getRedoxUsageShards(h HandlerArgs, keys []*datastore.Key) ([]*RedoxUsage, error) {
+	usages := make([]*RedoxUsage, len(keys))
+	for i := range usages {
+		usages[i] = &RedoxUsage{}
+	}
+
+	if err := h.Datastore.GetMulti(h.Context, keys, usages); err != nil {
+		multiErr, ok := err.(datastore.MultiError)
+		if !ok {
+			return nil, err
+		}
+
+		for _, err := range multiErr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	}
+
+	return usages, nil
+}
+
+func sumRedoxUsage(usages []*RedoxUsage, day int64) (int64, int64) {
+	dailyCount := int64(0)
+	totalCount := int64(0)
+
+	for _, usage := range usages {
+		if usage.Day == day {
+			dailyCount += usage.DailyCount
+		}
+
+		totalCount += usage.TotalCount
+	}
+
+	return dailyCount, totalCount
+}
+
+/* A call only counts if every key has room for it; on errRedoxRateLimited, returns seconds to wait */
+func consumeRedoxUsage(h HandlerArgs, redoxCredentialsList []*RedoxCredentials) (int64, error) {
+	var retryAfter int64
+
+	day := getTimestamp() / 86400000
+
+	/*
+		Only one shard per key is locked; daily quotas count the other shards as read
+		beforehand, so concurrent calls may overshoot a sharded quota slightly
+	*/
+
+	keys := []*datastore.Key{}
+	otherShardsDailyCounts := []int64{}
+	shardCounts := []int64{}
+
+	for _, redoxCredentials := range redoxCredentialsList {
+		usageKeys := getRedoxUsageKeys(redoxCredentials)
+		shardCount := getRedoxUsageShardCount(redoxCredentials)
+		shard := nonSecureRandom.Intn(shardCount)
+
+		otherShardsDailyCount := int64(0)
+
+		if len(usageKeys) > 1 {
+			usages, err := getRedoxUsageShards(h, usageKeys)
+			if err != nil {
+				return 0, err
+			}
+
+			otherShardsDailyCount, _ = sumRedoxUsage(append(usages[:shard:shard], usages[shard+1:]...), day)
+		}
+
+		keys = append(keys, usageKeys[shard])
+		otherShardsDailyCounts = append(otherShardsDailyCounts, otherShardsDailyCount)
+		shardCounts = append(shardCounts, int64(shardCount))
+	}
+
+	_, err := h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		retryAfter = 0
+		timestamp := getTimestamp()
+		day := timestamp / 86400000
+
+		usages := []*RedoxUsage{}
+
+		for i, redoxCredentials := range redoxCredentialsList {
+			usage := &RedoxUsage{}
+
+			if err := datastoreTransaction.Get(keys[i], usage); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+
+			dailyQuota := getRedoxLimit(redoxCredentials.DailyQuota, config.RedoxDefaultDailyQuota)
+			rateLimit := float64(getRedoxLimit(redoxCredentials.RateLimit, config.RedoxDefaultRateLimit)) /
+				float64(shardCounts[i])
+			rateLimitBurst := math.Max(
+				1,
+				float64(getRedoxLimit(redoxCredentials.RateLimitBurst, config.RedoxDefaultRateLimitBurst))/
+					float64(shardCounts[i]),
+			)
+
+			if usage.Day != day {
+				usage.Day = day
+				usage.DailyCount = 0
+			}
+
+			/* Token bucket refilled at rateLimit per minute, up to rateLimitBurst */
+			if rateLimit > 0 {
+				if usage.LastRefill == 0 {
+					usage.Tokens = rateLimitBurst
+				} else {
+					usage.Tokens = math.Min(
+						rateLimitBurst,
+						usage.Tokens+float64(timestamp-usage.LastRefill)*rateLimit/60000,
+					)
+				}
+
+				usage.LastRefill = timestamp
+
+				if usage.Tokens < 1 {
+					if wait := int64(math.Ceil((1 - usage.Tokens) * 60 / rateLimit)); wait > retryAfter {
+						retryAfter = wait
+					}
+				}
+			} else {
+				usage.LastRefill = 0
+			}
+
+			if dailyQuota > 0 && otherShardsDailyCounts[i]+usage.DailyCount >= dailyQuota {
+				if wait := int64(math.Ceil(float64((day+1)*86400000-timestamp) / 1000)); wait > retryAfter {
+					retryAfter = wait
+				}
+			}
+
+			usages = append(usages, usage)
+		}
+
+		if retryAfter > 0 {
+			return errRedoxRateLimited
+		}
+
+		for _, usage := range usages {
+			if usage.LastRefill != 0 {
+				usage.Tokens--
+			}
+
+			usage.DailyCount++
+			usage.TotalCount++
+		}
+
+		_, err := datastoreTransaction.PutMulti(keys, usages)
+		return err
+	})
+
+	/* Calls that still collide after the client library's retries are throttled rather than failed */
+	if err == datastore.ErrConcurrentTransaction {
+		return 1, errRedoxRateLimited
 	}
-
-	city := ""
-	if val, ok := record.City.Names[language]; ok {
-		city = val
-	} else if val, ok := record.City.Names[config.DefaultLanguageCode]; ok {
-		city = val
+	if err == errRedoxRateLimited {
+		return retryAfter, err
 	}
 
-	postalCode := record.Postal.Code
+	return 0, err
+}
 
-	analID := analIDs[city]
-	if analID == "" {
-		analID = countryCode
+func getRedoxUsage(redoxCredentials *RedoxCredentials, usages []*RedoxUsage) map[string]interface{} {
+	dailyCount, totalCount := sumRedoxUsage(usages, getTimestamp()/86400000)
+
+	return map[string]interface{}{
+		"apiKey":         redoxCredentials.APIKey,
+		"dailyCount":     dailyCount,
+		"dailyQuota":     getRedoxLimit(redoxCredentials.DailyQuota, config.RedoxDefaultDailyQuota),
+		"label":          redoxCredentials.Label,
+		"rateLimit":      getRedoxLimit(redoxCredentials.RateLimit, config.RedoxDefaultRateLimit),
+		"rateLimitBurst": getRedoxLimit(redoxCredentials.RateLimitBurst, config.RedoxDefaultRateLimitBurst),
+		"totalCount":     totalCount,
+		"username":       redoxCredentials.Username,
 	}
+}
 
-	firebaseRegion := config.DefaultFirebaseRegion
-	if val, ok := config.ContinentFirebaseRegions[continentCode]; ok {
-		firebaseRegion = val
+func getRedoxMasterCredentials(h HandlerArgs, masterAPIKey string) (*RedoxCredentials, error) {
+	redoxCredentials := &RedoxCredentials{}
+
+	if err := h.Datastore.Get(h.Context, datastoreKey("RedoxCredentials", masterAPIKey), redoxCredentials); err != nil ||
+		redoxCredentials.MasterAPIKey != "" {
+		return nil, errors.New("invalid master API key")
 	}
 
-	return continent, continentCode, country, countryCode, city, postalCode, analID, firebaseRegion
+	return redoxCredentials, nil
 }
 
-func getProFeaturesFromRequest(h HandlerArgs) map[string]bool {
-	return map[string]bool{
-		"disableP2P":     sanitize(h.Request.PostFormValue("proFeatures[disableP2P]")) == "true",
-		"modestBranding": sanitize(h.Request.PostFormValue("proFeatures[modestBranding]")) == "true",
-		"nativeCrypto":   sanitize(h.Request.PostFormValue("proFeatures[nativeCrypto]")) == "true",
-		"telehealth":     sanitize(h.Request.PostFormValue("proFeatures[telehealth]")) == "true",
-		"video":          sanitize(h.Request.PostFormValue("proFeatures[video]")) == "true",
-		"voice":          sanitize(h.Request.PostFormValue("proFeatures[voice]")) == "true",
+func getRedoxChildCredentials(h HandlerArgs, masterAPIKey string, apiKey string) (*RedoxCredentials, *datastore.Key, error) {
+	redoxCredentials := &RedoxCredentials{}
+	redoxCredentialsKey := datastoreKey("RedoxCredentials", apiKey)
+
+	if err := h.Datastore.Get(h.Context, redoxCredentialsKey, redoxCredentials); err != nil ||
+		masterAPIKey == "" ||
+		redoxCredentials.MasterAPIKey != masterAPIKey {
+		return nil, nil, errors.New("invalid API key")
 	}
+
+	return redoxCredentials, redoxCredentialsKey, nil
 }
 
-func getSignupFromRequest(h HandlerArgs) (BetaSignup, map[string]interface{}) {
-	_, _, country, countryCode, _, _, _, _ := geolocate(h)
+/* Comma-separated list of Redox data models, e.g. "Scheduling,PatientSearch" */
+func parseRedoxDataModels(dataModelsString string) []string {
+	dataModels := []string{}
 
-	signup := map[string]interface{}{}
-	profile := map[string]interface{}{}
+	for _, dataModel := range strings.Split(dataModelsString, ",") {
+		dataModel = strings.TrimSpace(dataModel)
+		if dataModel != "" {
+			dataModels = append(dataModels, dataModel)
+		}
+	}
 
-	usernameRequest := sanitize(h.Request.PostFormValue("usernameRequest"), config.MaxSignupValueLength)
+	return dataModels
+}
 
-	betaSignup := BetaSignup{
-		Comment:         sanitize(h.Request.PostFormValue("comment"), config.MaxSignupValueLength),
-		Country:         country,
-		Email:           sanitize(strings.ToLower(h.Request.PostFormValue("email")), config.MaxSignupValueLength),
-		Invited:         false,
-		Language:        sanitize(h.Request.PostFormValue("language"), config.MaxSignupValueLength),
-		Name:            sanitize(h.Request.PostFormValue("name"), config.MaxSignupValueLength),
-		Referer:         sanitize(h.Request.Referer(), config.MaxSignupValueLength),
-		Time:            time.Now().Unix(),
-		UsernameRequest: usernameRequest,
+/* Keys without an allow list may run any data model */
+func isRedoxDataModelAllowed(redoxCredentials *RedoxCredentials, dataModel string) bool {
+	if len(redoxCredentials.AllowedDataModels) < 1 {
+		return true
 	}
 
-	profile["country"] = countryCode
-	profile["first_name"] = betaSignup.Name
-	profile["http_referrer"] = betaSignup.Referer
-	profile["locale"] = betaSignup.Language
-	profile["custom_var1"] = sanitize(h.Request.PostFormValue("inviteCode"), config.MaxSignupValueLength)
-	profile["custom_var2"] = sanitize(h.Request.PostFormValue("featureInterest"), config.MaxSignupValueLength)
-	profile["custom_var3"] = usernameRequest
-	signup["email"] = betaSignup.Email
-	signup["profile"] = profile
+	for _, allowedDataModel := range redoxCredentials.AllowedDataModels {
+		if strings.EqualFold(allowedDataModel, dataModel) {
+			return true
+		}
+	}
 
-	return betaSignup, signup
+	return false
 }
 
-func getOrg(h HandlerArgs) string {
-	if appengine.IsDevAppServer() {
-		return config.DummyOrg
+func getRedoxField(node interface{}, path ...string) interface{} {
+	for _, k := range path {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			node = v[k]
+		default:
+			return nil
+		}
 	}
 
-	record, err := orgdb.ISP(getIP(h))
-	if err != nil {
-		return ""
+	return node
+}
+
+func getRedoxString(node interface{}, path ...string) string {
+	switch v := getRedoxField(node, path...).(type) {
+	case string:
+		return v
 	}
 
-	return record.Organization
+	return ""
 }
 
-func getIP(h HandlerArgs) []byte {
-	return net.ParseIP(getIPString(h))
+func getRedoxList(node interface{}, path ...string) []interface{} {
+	switch v := getRedoxField(node, path...).(type) {
+	case []interface{}:
+		return v
+	}
+
+	return []interface{}{}
 }
 
-func getIPString(h HandlerArgs) string {
-	xff := h.Request.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		return strings.Split(xff, ",")[0]
+func isRedoxCommandFieldEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []interface{}:
+		return len(v) < 1
+	case map[string]interface{}:
+		return len(v) < 1
 	}
 
-	ip, _, _ := net.SplitHostPort(h.Request.RemoteAddr)
-	return ip
+	return false
 }
 
-func getIPFSGateways(continentCode string) []string {
-	backupContinentCode := config.DefaultContinentCode
-	if backupContinentCode == continentCode {
-		backupContinentCode = config.DefaultContinentCodeBackup
+func newRedoxValidationError(field string, message string) map[string]string {
+	return map[string]string{"field": field, "message": message}
+}
+
+/* Returns field-level errors for commands that don't match a supported schema */
+func validateRedoxCommand(redoxCommand string) []map[string]string {
+	var command map[string]interface{}
+	if err := json.Unmarshal([]byte(redoxCommand), &command); err != nil {
+		return []map[string]string{newRedoxValidationError("", "invalid JSON: "+err.Error())}
 	}
 
-	checkAllIPFSGateways(false)
+	validationErrors := []map[string]string{}
 
-	gateways := append(
-		getIPFSGatewaysInternal(continentCode),
-		getIPFSGatewaysInternal(backupContinentCode)...,
-	)
+	dataModel, eventType := getRedoxCommandMetadata(redoxCommand)
 
-	if len(gateways) < 1 {
-		checkAllIPFSGateways(true)
-		return getIPFSGateways(continentCode)
+	if dataModel == "" {
+		validationErrors = append(validationErrors, newRedoxValidationError("Meta.DataModel", "required"))
+	}
+	if eventType == "" {
+		validationErrors = append(validationErrors, newRedoxValidationError("Meta.EventType", "required"))
+	}
+	if len(validationErrors) > 0 {
+		return validationErrors
 	}
 
-	return gateways
-}
+	eventTypes, ok := config.RedoxCommandSchemas[dataModel]
+	if !ok {
+		return []map[string]string{newRedoxValidationError("Meta.DataModel", "unsupported data model "+dataModel)}
+	}
 
-func getIPFSGatewaysInternal(continentCode string) []string {
-	now := time.Now().Unix()
+	requiredFields, ok := eventTypes[eventType]
+	if !ok {
+		return []map[string]string{
+			newRedoxValidationError("Meta.EventType", "unsupported event type "+eventType+" for "+dataModel),
+		}
+	}
 
-	allGateways := ipfsGateways[continentCode]
-	gateways := []string{}
+	for _, path := range requiredFields {
+		if isRedoxCommandFieldEmpty(getRedoxField(command, path...)) {
+			validationErrors = append(
+				validationErrors,
+				newRedoxValidationError(strings.Join(path, "."), "required"),
+			)
+		}
+	}
 
-	for i := range allGateways {
-		gateway := allGateways[i]
+	return validationErrors
+}
 
-		if uptimeCheck, ok := ipfsGatewayUptimeChecks[gateway]; ok && uptimeCheck.Result && config.IPFSGatewayUptimeCheckTTL > (now-uptimeCheck.Timestamp) {
-			gateways = append(gateways, gateway)
+func getRedoxCommandMetadata(redoxCommand string) (string, string) {
+	var command map[string]interface{}
+	if err := json.Unmarshal([]byte(redoxCommand), &command); err != nil {
+		return "", ""
+	}
+
+	meta := map[string]interface{}{}
+	if data, ok := command["Meta"]; ok {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			meta = v
 		}
 	}
 
-	if len(gateways) < 1 {
-		return gateways
+	dataModel := ""
+	if data, ok := meta["DataModel"]; ok {
+		switch v := data.(type) {
+		case string:
+			dataModel = v
+		}
 	}
 
-	index := nonSecureRandom.Intn(len(gateways))
+	eventType := ""
+	if data, ok := meta["EventType"]; ok {
+		switch v := data.(type) {
+		case string:
+			eventType = v
+		}
+	}
 
-	return append(
-		append([]string{gateways[index]}, gateways[:index]...),
-		gateways[index+1:]...,
-	)
+	return dataModel, eventType
 }
 
-func checkAllIPFSGateways(forceRetry bool) {
-	uptimeResults := make(chan bool, len(ipfsGatewayURLs))
+func hashRedoxPHI(value interface{}) string {
+	b, _ := json.Marshal(value)
 
-	for i := range ipfsGatewayURLs {
-		gateway := ipfsGatewayURLs[i].URL
+	mac := hmac.New(sha256.New, redoxLogHashSecret)
+	mac.Write(b)
 
-		go func() {
-			uptimeResults <- checkIPFSGateway(gateway, forceRetry)
-		}()
-	}
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func isRedoxLogPathAllowed(path []string) bool {
+	for _, allowedPath := range config.RedoxLogAllowedPaths {
+		if len(path) < len(allowedPath) {
+			continue
+		}
+
+		allowed := true
+		for i := range allowedPath {
+			if path[i] != allowedPath[i] {
+				allowed = false
+				break
+			}
+		}
 
-	for range ipfsGatewayURLs {
-		<-uptimeResults
+		if allowed {
+			return true
+		}
 	}
-}
 
-func checkIPFSGateway(gateway string, forceRetry bool) bool {
-	packageData := packages[config.DefaultPackage]
+	return false
+}
 
-	if packageData.Uptime.IPFSHash == "" {
-		return true
+/* Lists are transparent to paths, so Visits.Patient covers the patient of every visit */
+func redactRedoxPHI(node interface{}, path []string) interface{} {
+	if isRedoxLogPathAllowed(path) {
+		return node
 	}
 
-	if !forceRetry {
-		uptimeCheck, ok := ipfsGatewayUptimeChecks[gateway]
-		if ok && config.IPFSGatewayUptimeCheckTTL > (time.Now().Unix()-uptimeCheck.Timestamp) {
-			return uptimeCheck.Result
+	switch v := node.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = redactRedoxPHI(v[i], path)
 		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = redactRedoxPHI(v[k], append(path[:len(path):len(path)], k))
+		}
+		return v
+	case nil:
+		return v
 	}
 
-	result := true
+	return hashRedoxPHI(node)
+}
 
-	client := &http.Client{
-		Timeout: config.IPFSGatewayUptimeCheckTimeout,
+/* Returns false without a hash secret; unparseable bodies are hashed in full */
+func redactRedoxJSON(s string) (string, bool) {
+	if len(redoxLogHashSecret) < 1 {
+		return "", false
 	}
 
-	for i := 0; result && i < 5; i++ {
-		req, err := http.NewRequest(
-			methods.GET,
-			strings.Replace(gateway, ":hash", packageData.Uptime.IPFSHash, 1),
-			nil,
-		)
+	var o interface{}
+	if err := json.Unmarshal([]byte(s), &o); err != nil {
+		return hashRedoxPHI(s), true
+	}
 
-		if err == nil {
-			resp, err := client.Do(req)
-			if err == nil {
-				responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-				if err == nil {
-					response := hex.EncodeToString(responseBodyBytes)
-					if response == packageData.Uptime.IntegrityHash {
-						continue
-					}
-				}
-			}
-		}
+	b, err := json.Marshal(redactRedoxPHI(o, []string{}))
+	if err != nil {
+		return hashRedoxPHI(s), true
+	}
+
+	return string(b), true
+}
 
-		result = false
+func newFHIROperationOutcome(code string, diagnostics string) map[string]interface{} {
+	return map[string]interface{}{
+		"issue": []interface{}{
+			map[string]interface{}{
+				"code":        code,
+				"diagnostics": diagnostics,
+				"severity":    "error",
+			},
+		},
+		"resourceType": "OperationOutcome",
 	}
+}
 
-	ipfsGatewayUptimeChecks[gateway] = IPFSGatewayUptimeCheckData{
-		Result:    result,
-		Timestamp: time.Now().Unix(),
+func newFHIRBundle(resources []map[string]interface{}) map[string]interface{} {
+	entries := []interface{}{}
+	for _, resource := range resources {
+		entries = append(entries, map[string]interface{}{"resource": resource})
 	}
 
-	return result
+	return map[string]interface{}{
+		"entry":        entries,
+		"resourceType": "Bundle",
+		"total":        len(resources),
+		"type":         "searchset",
+	}
 }
 
-func braintreeDecimalToCents(d *braintree.Decimal) int64 {
-	if d.Scale == 2 {
-		return d.Unscaled
+/* Drops empty values so that translated resources only carry what Redox returned */
+func compactFHIRElement(element map[string]interface{}) map[string]interface{} {
+	for k, v := range element {
+		if isRedoxCommandFieldEmpty(v) {
+			delete(element, k)
+		}
 	}
 
-	return int64(float64(d.Unscaled) / math.Pow10(d.Scale-2))
+	return element
 }
 
-func braintreeInit(h HandlerArgs) *braintree.Braintree {
-	env := braintree.Sandbox
-
-	if isProd {
-		env = braintree.Production
+func appendFHIRElement(elements []interface{}, element map[string]interface{}) []interface{} {
+	if element = compactFHIRElement(element); len(element) > 0 {
+		elements = append(elements, element)
 	}
 
-	bt := braintree.New(
-		env,
-		braintreeMerchantID,
-		braintreePublicKey,
-		braintreePrivateKey,
-	)
+	return elements
+}
 
-	bt.HttpClient = &http.Client{}
+/* Prefers the identifier of the configured type, falling back to the first one listed */
+func getFHIRID(identifiers []interface{}, idType string) string {
+	for _, identifier := range identifiers {
+		if getRedoxString(identifier, "IDType") == idType {
+			return getRedoxString(identifier, "ID")
+		}
+	}
 
-	return bt
+	if len(identifiers) > 0 {
+		return getRedoxString(identifiers[0], "ID")
+	}
+
+	return ""
 }
 
-func downgradeAccountHelper(userToken string, removeAppStoreReceiptRef bool) (string, string, error) {
-	body, _ := json.Marshal(map[string]interface{}{
-		"namespace":                "cyph.ws",
-		"removeAppStoreReceiptRef": removeAppStoreReceiptRef,
-		"userToken":                userToken,
+func getFHIRAddresses(address interface{}) []interface{} {
+	line := []interface{}{}
+	if streetAddress := getRedoxString(address, "StreetAddress"); streetAddress != "" {
+		line = append(line, streetAddress)
+	}
+
+	return appendFHIRElement([]interface{}{}, map[string]interface{}{
+		"city":       getRedoxString(address, "City"),
+		"country":    getRedoxString(address, "Country"),
+		"district":   getRedoxString(address, "County"),
+		"line":       line,
+		"postalCode": getRedoxString(address, "ZIP"),
+		"state":      getRedoxString(address, "State"),
 	})
+}
 
-	client := &http.Client{}
+func getFHIRTelecom(node interface{}) []interface{} {
+	telecom := []interface{}{}
 
-	req, _ := http.NewRequest(
-		methods.POST,
-		firebaseFunctionURL+"downgradeAccount",
-		bytes.NewBuffer(body),
-	)
+	for _, use := range []string{"Home", "Mobile", "Office"} {
+		phoneNumber := getRedoxString(node, "PhoneNumber", use)
+		if phoneNumber == "" {
+			continue
+		}
 
-	req.Header.Add("Authorization", cyphFirebaseAdminKey)
-	req.Header.Add("Content-Type", "application/json")
+		fhirUse := strings.ToLower(use)
+		if use == "Office" {
+			fhirUse = "work"
+		}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", err
+		telecom = append(telecom, map[string]interface{}{
+			"system": "phone",
+			"use":    fhirUse,
+			"value":  phoneNumber,
+		})
 	}
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", err
+	for _, emailAddress := range getRedoxList(node, "EmailAddresses") {
+		if s, ok := emailAddress.(string); ok && s != "" {
+			telecom = append(telecom, map[string]interface{}{
+				"system": "email",
+				"value":  s,
+			})
+		}
 	}
 
-	var responseBody map[string]interface{}
-	err = json.Unmarshal(responseBodyBytes, &responseBody)
-	if err != nil {
-		return "", "", err
-	}
+	return telecom
+}
 
-	appStoreReceipt := ""
-	if data, ok := responseBody["appStoreReceipt"]; ok {
-		switch v := data.(type) {
-		case string:
-			appStoreReceipt = v
-		}
+func getFHIRIdentifiers(identifiers []interface{}) []interface{} {
+	fhirIdentifiers := []interface{}{}
+
+	for _, identifier := range identifiers {
+		fhirIdentifiers = appendFHIRElement(fhirIdentifiers, map[string]interface{}{
+			"system": getRedoxString(identifier, "IDType"),
+			"value":  getRedoxString(identifier, "ID"),
+		})
 	}
 
-	braintreeSubscriptionID := ""
-	if data, ok := responseBody["braintreeSubscriptionID"]; ok {
-		switch v := data.(type) {
-		case string:
-			braintreeSubscriptionID = v
+	return fhirIdentifiers
+}
+
+func getFHIRNames(firstName string, middleName string, lastName string, suffix []interface{}) []interface{} {
+	given := []interface{}{}
+	for _, name := range []string{firstName, middleName} {
+		if name != "" {
+			given = append(given, name)
 		}
 	}
 
-	return appStoreReceipt, braintreeSubscriptionID, nil
+	return appendFHIRElement([]interface{}{}, map[string]interface{}{
+		"family": lastName,
+		"given":  given,
+		"suffix": suffix,
+	})
 }
 
-func generateInvite(email, name, plan, appStoreReceipt string, braintreeIDs, braintreeSubscriptionIDs []string, inviteCode, username string, giftPack, purchased bool) (string, string, string, error) {
-	body, _ := json.Marshal(map[string]interface{}{
-		"appStoreReceipt":          appStoreReceipt,
-		"braintreeIDs":             strings.Join(braintreeIDs, "\n"),
-		"braintreeSubscriptionIDs": strings.Join(braintreeSubscriptionIDs, "\n"),
-		"email":                    email,
-		"giftPack":                 giftPack,
-		"inviteCode":               inviteCode,
-		"name":                     name,
-		"namespace":                "cyph.ws",
-		"plan":                     plan,
-		"purchased":                purchased,
-		"username":                 username,
-	})
+/* FHIR search dates may carry a comparison prefix, e.g. ge2020-01-01 */
+func parseFHIRSearchDate(value string) (int64, string, error) {
+	prefix := "eq"
+	if len(value) > 2 {
+		switch value[0:2] {
+		case "eq", "ge", "gt", "le", "lt":
+			prefix = value[0:2]
+			value = value[2:]
+		}
+	}
 
-	client := &http.Client{}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return 0, "", errors.New("invalid date " + value)
+	}
 
-	req, _ := http.NewRequest(
-		methods.POST,
-		firebaseFunctionURL+"generateInvite",
-		bytes.NewBuffer(body),
-	)
+	return t.UnixNano() / 1e6, prefix, nil
+}
 
-	req.Header.Add("Authorization", cyphFirebaseAdminKey)
-	req.Header.Add("Content-Type", "application/json")
+func formatRedoxTimestamp(timestamp int64) string {
+	return time.Unix(0, timestamp*1e6).UTC().Format("2006-01-02T15:04:05.000Z")
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", "", err
+/* Runs a Redox query on behalf of a FHIR request, returning an OperationOutcome on failure */
+func runFHIRRedoxQuery(
+	h HandlerArgs,
+	dataModel string,
+	eventType string,
+	redoxCommand map[string]interface{},
+) (map[string]interface{}, map[string]interface{}, int) {
+	apiKeyOrMasterAPIKey := sanitize(strings.TrimPrefix(h.Request.Header.Get("Authorization"), "Bearer "))
+	destination := sanitize(h.Request.Header.Get("X-Redox-Destination"))
+
+	if apiKeyOrMasterAPIKey == "" {
+		return nil, newFHIROperationOutcome("login", "missing API key"), http.StatusUnauthorized
+	}
+	if destination == "" {
+		return nil, newFHIROperationOutcome("required", "missing X-Redox-Destination header"), http.StatusBadRequest
 	}
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", "", err
+	redoxCommand["Meta"] = map[string]interface{}{
+		"DataModel":    dataModel,
+		"Destinations": []interface{}{map[string]interface{}{"ID": destination}},
+		"EventType":    eventType,
 	}
 
-	var responseBody map[string]interface{}
-	err = json.Unmarshal(responseBodyBytes, &responseBody)
+	b, err := json.Marshal(redoxCommand)
 	if err != nil {
-		return "", "", "", err
+		return nil, newFHIROperationOutcome("exception", err.Error()), http.StatusInternalServerError
 	}
 
-	if data, ok := responseBody["inviteCode"]; ok {
-		switch v := data.(type) {
-		case string:
-			inviteCode = v
+	responseBody, responseCode := runRedoxCommand(h, apiKeyOrMasterAPIKey, string(b))
+
+	if responseCode != http.StatusOK {
+		diagnostics, ok := responseBody.(string)
+		if !ok {
+			b, _ := json.Marshal(responseBody)
+			diagnostics = string(b)
 		}
-	}
 
-	oldBraintreeSubscriptionID := ""
-	if data, ok := responseBody["oldBraintreeSubscriptionID"]; ok {
-		switch v := data.(type) {
-		case string:
-			oldBraintreeSubscriptionID = v
+		code := "exception"
+		switch responseCode {
+		case http.StatusBadRequest:
+			code = "invalid"
+		case http.StatusForbidden, http.StatusNotFound:
+			code = "security"
+		case http.StatusTooManyRequests:
+			code = "throttled"
 		}
+
+		return nil, newFHIROperationOutcome(code, diagnostics), responseCode
 	}
 
-	welcomeLetter := ""
-	if data, ok := responseBody["welcomeLetter"]; ok {
-		switch v := data.(type) {
-		case string:
-			welcomeLetter = v
-		}
+	responseString, _ := responseBody.(string)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(responseString), &response); err != nil {
+		return nil, newFHIROperationOutcome("exception", "invalid Redox response"), http.StatusBadGateway
 	}
 
-	return inviteCode, oldBraintreeSubscriptionID, welcomeLetter, nil
+	if redoxErrors := getRedoxList(response, "Meta", "Errors"); len(redoxErrors) > 0 {
+		return nil, newFHIROperationOutcome("exception", getRedoxString(redoxErrors[0], "Text")), http.StatusBadGateway
+	}
+
+	return response, nil, http.StatusOK
 }
 
-func getBraintreeSubscriptionID(userToken string) (string, string, int64, error) {
-	body, _ := json.Marshal(map[string]interface{}{
-		"namespace": "cyph.ws",
-		"userToken": userToken,
-	})
+func translateRedoxPatient(patient interface{}) map[string]interface{} {
+	demographics := getRedoxField(patient, "Demographics")
+	identifiers := getRedoxList(patient, "Identifiers")
 
-	client := &http.Client{}
+	gender := strings.ToLower(getRedoxString(demographics, "Sex"))
+	switch gender {
+	case "", "female", "male", "other":
+	default:
+		gender = "unknown"
+	}
 
-	req, _ := http.NewRequest(
-		methods.POST,
-		firebaseFunctionURL+"getBraintreeSubscriptionID",
-		bytes.NewBuffer(body),
-	)
+	return compactFHIRElement(map[string]interface{}{
+		"address":      getFHIRAddresses(getRedoxField(demographics, "Address")),
+		"birthDate":    getRedoxString(demographics, "DOB"),
+		"gender":       gender,
+		"id":           getFHIRID(identifiers, config.FHIRPatientIDType),
+		"identifier":   getFHIRIdentifiers(identifiers),
+		"resourceType": "Patient",
+		"telecom":      getFHIRTelecom(demographics),
+		"name": getFHIRNames(
+			getRedoxString(demographics, "FirstName"),
+			getRedoxString(demographics, "MiddleName"),
+			getRedoxString(demographics, "LastName"),
+			nil,
+		),
+	})
+}
 
-	req.Header.Add("Authorization", cyphFirebaseAdminKey)
-	req.Header.Add("Content-Type", "application/json")
+func translateRedoxProvider(provider interface{}) map[string]interface{} {
+	identifiers := []interface{}{provider}
+
+	return compactFHIRElement(map[string]interface{}{
+		"address":      getFHIRAddresses(getRedoxField(provider, "Address")),
+		"id":           getFHIRID(identifiers, config.FHIRPractitionerIDType),
+		"identifier":   getFHIRIdentifiers(identifiers),
+		"resourceType": "Practitioner",
+		"telecom":      getFHIRTelecom(provider),
+		"name": getFHIRNames(
+			getRedoxString(provider, "FirstName"),
+			getRedoxString(provider, "MiddleName"),
+			getRedoxString(provider, "LastName"),
+			getRedoxList(provider, "Credentials"),
+		),
+	})
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", 0, err
+func translateRedoxVisit(visit interface{}) map[string]interface{} {
+	status := "booked"
+	switch strings.ToLower(getRedoxString(visit, "Status")) {
+	case "arrived":
+		status = "arrived"
+	case "canceled", "cancelled":
+		status = "cancelled"
+	case "completed", "discharged":
+		status = "fulfilled"
+	case "no show", "noshow":
+		status = "noshow"
 	}
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", 0, err
+	start := getRedoxString(visit, "VisitDateTime")
+	end := ""
+	minutesDuration := int64(0)
+
+	if duration, ok := getRedoxField(visit, "Duration").(float64); ok {
+		minutesDuration = int64(duration)
+
+		if t, err := time.Parse(time.RFC3339, start); err == nil {
+			end = formatRedoxTimestamp(t.Add(time.Minute*time.Duration(minutesDuration)).UnixNano() / 1e6)
+		}
 	}
 
-	var responseBody map[string]interface{}
-	err = json.Unmarshal(responseBodyBytes, &responseBody)
-	if err != nil {
-		return "", "", 0, err
+	participants := []interface{}{}
+
+	patientID := getFHIRID(getRedoxList(visit, "Patient", "Identifiers"), config.FHIRPatientIDType)
+	if patientID != "" {
+		participants = append(participants, map[string]interface{}{
+			"actor":  map[string]interface{}{"reference": "Patient/" + patientID},
+			"status": "accepted",
+		})
 	}
 
-	appStoreReceipt := ""
-	if data, ok := responseBody["appStoreReceipt"]; ok {
-		switch v := data.(type) {
-		case string:
-			appStoreReceipt = v
+	for _, providerField := range []string{"VisitProvider", "AttendingProvider"} {
+		provider := getRedoxField(visit, providerField)
+		providerID := getFHIRID([]interface{}{provider}, config.FHIRPractitionerIDType)
+
+		if providerID == "" {
+			continue
 		}
+
+		participants = append(participants, map[string]interface{}{
+			"actor": compactFHIRElement(map[string]interface{}{
+				"display": strings.TrimSpace(
+					getRedoxString(provider, "FirstName") + " " + getRedoxString(provider, "LastName"),
+				),
+				"reference": "Practitioner/" + providerID,
+			}),
+			"status": "accepted",
+		})
+
+		break
 	}
 
-	braintreeSubscriptionID := ""
-	if data, ok := responseBody["braintreeSubscriptionID"]; ok {
-		switch v := data.(type) {
-		case string:
-			braintreeSubscriptionID = v
-		}
+	location := strings.TrimSpace(
+		getRedoxString(visit, "Location", "Facility") + " " + getRedoxString(visit, "Location", "Department"),
+	)
+	if location != "" {
+		participants = append(participants, map[string]interface{}{
+			"actor":  map[string]interface{}{"display": location},
+			"status": "accepted",
+		})
 	}
 
-	planTrialEnd := int64(0)
-	if data, ok := responseBody["planTrialEnd"]; ok {
-		switch v := data.(type) {
-		case float64:
-			planTrialEnd = int64(v)
-		}
+	appointment := compactFHIRElement(map[string]interface{}{
+		"description":  getRedoxString(visit, "Reason"),
+		"end":          end,
+		"id":           getFHIRAppointmentID(patientID, getRedoxString(visit, "VisitNumber")),
+		"participant":  participants,
+		"resourceType": "Appointment",
+		"start":        start,
+		"status":       status,
+	})
+
+	if minutesDuration > 0 {
+		appointment["minutesDuration"] = minutesDuration
 	}
 
-	return appStoreReceipt, braintreeSubscriptionID, planTrialEnd, nil
+	return appointment
 }
 
-func getUsername(userToken string) (string, error) {
-	body, _ := json.Marshal(map[string]interface{}{
-		"namespace": "cyph.ws",
-		"userToken": userToken,
-	})
+/* Redox has no visit lookup by number, so Appointment IDs carry the patient that reads are scoped to */
+func getFHIRAppointmentID(patientID string, visitNumber string) string {
+	if patientID == "" || visitNumber == "" {
+		return visitNumber
+	}
 
-	client := &http.Client{}
+	return patientID + "." + visitNumber
+}
 
-	req, _ := http.NewRequest(
-		methods.POST,
-		firebaseFunctionURL+"openUserToken",
-		bytes.NewBuffer(body),
-	)
+func splitFHIRAppointmentID(id string) (string, string) {
+	i := strings.LastIndex(id, ".")
+	if i < 1 || i == len(id)-1 {
+		return "", id
+	}
 
-	req.Header.Add("Authorization", cyphFirebaseAdminKey)
-	req.Header.Add("Content-Type", "application/json")
+	return id[0:i], id[i+1:]
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+func searchFHIRAppointments(
+	h HandlerArgs,
+	start int64,
+	end int64,
+	patientID string,
+) ([]map[string]interface{}, map[string]interface{}, int) {
+	redoxCommand := map[string]interface{}{
+		"EndDateTime":   formatRedoxTimestamp(end),
+		"StartDateTime": formatRedoxTimestamp(start),
 	}
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if patientID != "" {
+		redoxCommand["Patients"] = []interface{}{
+			map[string]interface{}{
+				"Identifiers": []interface{}{
+					map[string]interface{}{"ID": patientID, "IDType": config.FHIRPatientIDType},
+				},
+			},
+		}
 	}
 
-	var responseBody map[string]interface{}
-	err = json.Unmarshal(responseBodyBytes, &responseBody)
-	if err != nil {
-		return "", err
+	response, outcome, responseCode := runFHIRRedoxQuery(h, "Scheduling", "Booked", redoxCommand)
+	if outcome != nil {
+		return nil, outcome, responseCode
 	}
 
-	username := ""
-	if data, ok := responseBody["username"]; ok {
-		switch v := data.(type) {
-		case string:
-			username = v
-		}
+	appointments := []map[string]interface{}{}
+	for _, visit := range getRedoxList(response, "Visits") {
+		appointments = append(appointments, translateRedoxVisit(visit))
 	}
 
-	return username, nil
+	return appointments, nil, http.StatusOK
 }
 
-func getCustomer(h HandlerArgs) (*Customer, *datastore.Key, error) {
-	var apiKey string
-	if authHeader, ok := h.Request.Header["Authorization"]; ok && len(authHeader) > 0 {
-		apiKey = authHeader[0]
-	} else {
-		return nil, nil, errors.New("must include an API key")
-	}
+/* Events sort by master API key, then by arrival; the key is hashed as child keys see event IDs and cursors */
+func getRedoxEventKeyName(masterAPIKey string, timestamp int64) string {
+	return fmt.Sprintf("%s:%015d:", hashRedoxAPIKey(masterAPIKey), timestamp)
+}
 
-	customer := &Customer{}
-	customerKey := datastoreKey("Customer", apiKey)
+/* Event IDs omit the master API key hash, which is the same for every event a key holder sees */
+func getRedoxEventID(masterAPIKey string, keyName string) string {
+	return strings.TrimPrefix(keyName, hashRedoxAPIKey(masterAPIKey)+":")
+}
 
-	if err := h.Datastore.Get(h.Context, customerKey, customer); err != nil {
-		return nil, nil, errors.New("invalid API key")
-	}
+func hashRedoxAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
 
-	return customer, customerKey, nil
+func hashRedoxVerificationToken(verificationToken string) string {
+	hash := sha256.Sum256([]byte(verificationToken))
+	return hex.EncodeToString(hash[:])
 }
 
-func getAppStoreTransactionDataInternal(appStoreReceipt string, sandbox bool) (string, error) {
-	body, _ := json.Marshal(map[string]interface{}{
-		"password":     appStoreSecret,
-		"receipt-data": appStoreReceipt,
-	})
+/* Zero-padded so that key names sort chronologically */
+func getRedoxRequestLogKeyName(masterAPIKey string, username string, timestamp int64) string {
+	return fmt.Sprintf("%s:%s:%015d:", masterAPIKey, username, timestamp)
+}
 
-	client := &http.Client{}
+func isRedoxAuthValid(redoxAuth *RedoxAuth) bool {
+	return redoxAuth != nil &&
+		redoxAuth.AccessToken != "" &&
+		redoxAuth.Expires >= getTimestamp()+config.RedoxAuthExpirationBuffer
+}
 
-	url := "https://buy.itunes.apple.com/verifyReceipt"
-	if sandbox {
-		url = "https://sandbox.itunes.apple.com/verifyReceipt"
+func invalidateRedoxAuth(redoxAPIKey string) {
+	redoxAuthCache.Lock()
+	defer redoxAuthCache.Unlock()
+
+	if redoxAuth, ok := redoxAuthCache.auth[redoxAPIKey]; ok {
+		redoxAuthCache.auth[redoxAPIKey] = &RedoxAuth{
+			AccessToken:  redoxAuth.AccessToken,
+			Expires:      0,
+			RedoxAPIKey:  redoxAPIKey,
+			RefreshToken: redoxAuth.RefreshToken,
+		}
 	}
+}
 
-	req, _ := http.NewRequest(
-		methods.POST,
-		url,
-		bytes.NewBuffer(body),
-	)
+/* Concurrent callers for the same Redox API key share a single in-flight refresh */
+func getRedoxAuth(h HandlerArgs, redoxCredentials *RedoxCredentials) (RedoxAuth, error) {
+	redoxAPIKey := redoxCredentials.RedoxAPIKey
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
+	redoxAuthCache.Lock()
 
-	responseBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if redoxAuth, ok := redoxAuthCache.auth[redoxAPIKey]; ok && isRedoxAuthValid(redoxAuth) {
+		redoxAuthCache.Unlock()
+		return *redoxAuth, nil
 	}
 
-	var responseBody map[string]interface{}
-	err = json.Unmarshal(responseBodyBytes, &responseBody)
-	if err != nil {
-		return "", err
-	}
+	if refresh, ok := redoxAuthCache.refreshes[redoxAPIKey]; ok {
+		redoxAuthCache.Unlock()
+		<-refresh.Done
 
-	status := int64(-1)
-	if data, ok := responseBody["status"]; ok {
-		switch v := data.(type) {
-		case float64:
-			status = int64(v)
+		if refresh.Error != nil {
+			return RedoxAuth{}, refresh.Error
 		}
-	}
 
-	if !sandbox && status == 21007 {
-		return getAppStoreTransactionDataInternal(appStoreReceipt, true)
+		return *refresh.Auth, nil
 	}
 
-	if status != 0 {
-		return "", errors.New("Error status: " + string(status))
-	}
+	refresh := &RedoxAuthRefresh{Done: make(chan struct{})}
+	redoxAuthCache.refreshes[redoxAPIKey] = refresh
+	cachedRedoxAuth := redoxAuthCache.auth[redoxAPIKey]
 
-	receiptData := map[string]interface{}{}
-	if data, ok := responseBody["receipt"]; ok {
-		switch v := data.(type) {
-		case map[string]interface{}:
-			receiptData = v
-		}
-	}
+	redoxAuthCache.Unlock()
 
-	inAppData := map[string]interface{}{}
-	if data, ok := receiptData["in_app"]; ok {
-		switch v := data.(type) {
-		case []interface{}:
-			if len(v) > 0 {
-				o := v[len(v)-1]
-				switch value := o.(type) {
-				case map[string]interface{}:
-					inAppData = value
-				}
-			}
-		}
-	}
+	refresh.Auth, refresh.Error = refreshRedoxAuth(h, redoxCredentials, cachedRedoxAuth)
 
-	productID := ""
-	if data, ok := inAppData["product_id"]; ok {
-		switch v := data.(type) {
-		case string:
-			productID = v
-		}
+	redoxAuthCache.Lock()
+
+	if refresh.Error == nil {
+		redoxAuthCache.auth[redoxAPIKey] = refresh.Auth
 	}
+	delete(redoxAuthCache.refreshes, redoxAPIKey)
+	close(refresh.Done)
 
-	planID, ok := config.PlanAppleIDs[productID]
-	if !ok {
-		return "", errors.New("Invalid data from App Store receipt: " + string(responseBodyBytes))
+	redoxAuthCache.Unlock()
+
+	if refresh.Error != nil {
+		return RedoxAuth{}, refresh.Error
 	}
 
-	return planID, nil
+	return *refresh.Auth, nil
 }
 
-func getAppStoreTransactionData(appStoreReceipt string) (string, error) {
-	return getAppStoreTransactionDataInternal(appStoreReceipt, false)
-}
+func refreshRedoxAuth(h HandlerArgs, redoxCredentials *RedoxCredentials, cachedRedoxAuth *RedoxAuth) (*RedoxAuth, error) {
+	redoxAPIKey := redoxCredentials.RedoxAPIKey
+	redoxAuthKey := datastoreKey("RedoxAuth", redoxAPIKey)
 
-func getBitPayInvoice(id string) (map[string]interface{}, error) {
-	client := &http.Client{}
+	/* Another instance may have already refreshed, unless it's the token we just invalidated */
+	storedRedoxAuth := &RedoxAuth{}
+	if err := h.Datastore.Get(h.Context, redoxAuthKey, storedRedoxAuth); err == nil && decryptRedoxAuth(storedRedoxAuth) == nil {
+		if isRedoxAuthValid(storedRedoxAuth) &&
+			(cachedRedoxAuth == nil || cachedRedoxAuth.AccessToken != storedRedoxAuth.AccessToken) {
+			return storedRedoxAuth, nil
+		}
+	} else if cachedRedoxAuth != nil {
+		storedRedoxAuth = cachedRedoxAuth
+	}
 
-	req, _ := http.NewRequest(
-		methods.GET,
-		"https://bitpay.com/invoices/"+id+"?token="+config.BitPayToken,
-		nil,
-	)
+	var redoxAuth *RedoxAuth
+	var err error
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if storedRedoxAuth.RefreshToken != "" {
+		redoxAuth, err = requestRedoxAuth("refreshToken", map[string]string{
+			"apiKey":       redoxAPIKey,
+			"refreshToken": storedRedoxAuth.RefreshToken,
+		})
+	}
+
+	/* Fall back to full authentication if there's no usable refresh token */
+	if redoxAuth == nil {
+		if err != nil {
+			log.Printf("Redox token refresh failed for %s; re-authenticating: %v", redoxAPIKey, err)
+		}
+
+		redoxAuth, err = requestRedoxAuth("authenticate", map[string]string{
+			"apiKey": redoxAPIKey,
+			"secret": redoxCredentials.RedoxSecret,
+		})
 	}
 
-	jsonBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	var body map[string]interface{}
-	err = json.Unmarshal(jsonBody, &body)
+	redoxAuth.RedoxAPIKey = redoxAPIKey
+
+	encryptedRedoxAuth, err := encryptRedoxAuth(redoxAuth)
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to encrypt Redox auth for %s: %v", redoxAPIKey, err)
+		return redoxAuth, nil
 	}
 
-	if data, ok := body["data"]; ok {
-		switch v := data.(type) {
-		case map[string]interface{}:
-			return v, nil
+	_, err = h.Datastore.RunInTransaction(h.Context, func(datastoreTransaction *datastore.Transaction) error {
+		currentRedoxAuth := &RedoxAuth{}
+
+		/* Keep whichever token was issued last if another instance raced us */
+		if err := datastoreTransaction.Get(redoxAuthKey, currentRedoxAuth); err == nil &&
+			decryptRedoxAuth(currentRedoxAuth) == nil &&
+			isRedoxAuthValid(currentRedoxAuth) &&
+			currentRedoxAuth.Expires > redoxAuth.Expires {
+			redoxAuth = currentRedoxAuth
+			return nil
+		}
+
+		if _, err := datastoreTransaction.Put(redoxAuthKey, encryptedRedoxAuth); err != nil {
+			datastoreTransaction.Rollback()
+			return err
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Failed to persist Redox auth for %s: %v", redoxAPIKey, err)
 	}
 
-	return nil, errors.New("invalid invoice ID: " + id)
+	return redoxAuth, nil
 }
 
 func getTwilioToken(h HandlerArgs) map[string]interface{} {
@@ -1046,13 +4160,8 @@ func handleFuncs(pattern string, cron bool, handlers Handlers) {
 				responseBody = config.AllowedMethods
 				responseCode = http.StatusOK
 			} else {
-				projectID := datastore.DetectProjectID
-				if appengine.IsDevAppServer() {
-					projectID = "test"
-				}
-
 				context := r.Context()
-				datastoreClient, err := datastore.NewClient(context, projectID)
+				datastoreClient, err := datastore.NewClient(context, getDatastoreProjectID())
 
 				if err != nil {
 					responseBody = "Failed to create context."
@@ -1253,9 +4362,11 @@ func sendMail(to string, subject string, text string, html string) {
 	}
 }
 
-func getPlanData(h HandlerArgs, customer *Customer) (map[string]bool, int64, error) {
+func getPlanData(h HandlerArgs, customer *Customer) (map[string]bool, int64, int64, int64, error) {
 	proFeatures := map[string]bool{}
 	sessionCountLimit := int64(0)
+	preAuthorizationLifetime := int64(0)
+	preAuthorizationUses := int64(0)
 	plans := []Plan{}
 
 	if customer.BraintreeID != "" {
@@ -1263,7 +4374,7 @@ func getPlanData(h HandlerArgs, customer *Customer) (map[string]bool, int64, err
 		braintreeCustomer, err := bt.Customer().Find(h.Context, customer.BraintreeID)
 
 		if err != nil {
-			return proFeatures, sessionCountLimit, err
+			return proFeatures, sessionCountLimit, preAuthorizationLifetime, preAuthorizationUses, err
 		}
 		subscriptions := []*braintree.Subscription{}
 
@@ -1313,7 +4424,15 @@ func getPlanData(h HandlerArgs, customer *Customer) (map[string]bool, int64, err
 		if plan.SessionCountLimit > sessionCountLimit || plan.SessionCountLimit == -1 {
 			sessionCountLimit = plan.SessionCountLimit
 		}
+
+		if plan.PreAuthorizationLifetime > preAuthorizationLifetime {
+			preAuthorizationLifetime = plan.PreAuthorizationLifetime
+		}
+
+		if preAuthorizationUses != -1 && (plan.PreAuthorizationUses > preAuthorizationUses || plan.PreAuthorizationUses == -1) {
+			preAuthorizationUses = plan.PreAuthorizationUses
+		}
 	}
 
-	return proFeatures, sessionCountLimit, nil
+	return proFeatures, sessionCountLimit, preAuthorizationLifetime, preAuthorizationUses, nil
 }
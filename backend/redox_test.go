@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+/* Handler tests need a datastore, e.g. the emulator that commands/redoxtest.sh starts */
+func newTestHandlerArgs(t *testing.T, method string, target string, form url.Values) (HandlerArgs, *httptest.ResponseRecorder) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is unset")
+	}
+
+	ctx := context.Background()
+
+	datastoreClient, err := datastore.NewClient(ctx, getDatastoreProjectID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+
+	return HandlerArgs{
+		Context:   ctx,
+		Datastore: datastoreClient,
+		Request:   req,
+		Writer:    w,
+		Vars:      map[string]string{},
+	}, w
+}
+
+func putTestRedoxCredentials(t *testing.T, h HandlerArgs, redoxCredentials *RedoxCredentials) string {
+	apiKey := generateRandomID()
+	redoxCredentials.APIKey = apiKey
+
+	if _, err := h.Datastore.Put(h.Context, datastoreKey("RedoxCredentials", apiKey), redoxCredentials); err != nil {
+		t.Fatal(err)
+	}
+
+	return apiKey
+}
+
+func TestRedactRedoxSchedulingResponse(t *testing.T) {
+	originalRedoxLogHashSecret := redoxLogHashSecret
+	redoxLogHashSecret = []byte("redoxtest")
+	defer func() { redoxLogHashSecret = originalRedoxLogHashSecret }()
+
+	response := `{
+		"Meta": {
+			"DataModel": "Scheduling",
+			"EventType": "Booked",
+			"Errors": [{"Text": "Bixby not found"}]
+		},
+		"Patients": [{"Identifiers": [{"ID": "0000000001", "IDType": "MR"}]}],
+		"Visits": [{
+			"AttendingProvider": {"FirstName": "Pat", "ID": "4356789876", "LastName": "Granite"},
+			"Location": {"Department": "3N", "Facility": "RES General Hospital"},
+			"Patient": {
+				"Demographics": {"FirstName": "Timothy", "LastName": "Bixby"},
+				"Identifiers": [{"ID": "0000000001", "IDType": "MR"}]
+			},
+			"Reason": "Checkup",
+			"VisitDateTime": "2026-10-19T15:00:00.000Z",
+			"VisitNumber": "1234"
+		}]
+	}`
+
+	redacted, ok := redactRedoxJSON(response)
+	if !ok {
+		t.Fatal("not redacted")
+	}
+
+	for _, phi := range []string{
+		"0000000001",
+		"2026-10-19",
+		"4356789876",
+		"Bixby",
+		"Checkup",
+		"Granite",
+		"RES General Hospital",
+		"Timothy",
+	} {
+		if strings.Contains(redacted, phi) {
+			t.Errorf("%s not redacted: %s", phi, redacted)
+		}
+	}
+
+	var o map[string]interface{}
+	if err := json.Unmarshal([]byte(redacted), &o); err != nil {
+		t.Fatal(err)
+	}
+
+	if dataModel := getRedoxString(o, "Meta", "DataModel"); dataModel != "Scheduling" {
+		t.Errorf("expected Meta.DataModel to be kept, got %q", dataModel)
+	}
+
+	if id := getRedoxString(getRedoxList(o, "Visits")[0], "VisitNumber"); !strings.HasPrefix(id, "redacted:") {
+		t.Errorf("expected a keyed hash, got %q", id)
+	}
+}
+
+func TestRedactRedoxWithoutSecret(t *testing.T) {
+	originalRedoxLogHashSecret := redoxLogHashSecret
+	redoxLogHashSecret = nil
+	defer func() { redoxLogHashSecret = originalRedoxLogHashSecret }()
+
+	if _, ok := redactRedoxJSON(`{"Patient": {"Identifiers": [{"ID": "0000000001"}]}}`); ok {
+		t.Error("redacted without a hash secret")
+	}
+}
+
+func TestRedoxRestrictedDataModel(t *testing.T) {
+	redoxCredentials := &RedoxCredentials{AllowedDataModels: []string{"PatientSearch", "Scheduling"}}
+
+	for dataModel, allowed := range map[string]bool{
+		"PatientSearch": true,
+		"Provider":      false,
+		"scheduling":    true,
+	} {
+		if isRedoxDataModelAllowed(redoxCredentials, dataModel) != allowed {
+			t.Errorf("%s: expected allowed=%v", dataModel, allowed)
+		}
+	}
+
+	if !isRedoxDataModelAllowed(&RedoxCredentials{}, "Provider") {
+		t.Error("unrestricted key rejected Provider")
+	}
+}
+
+func TestRedoxVerifyDisabledAPIKey(t *testing.T) {
+	h, _ := newTestHandlerArgs(t, "POST", "/redox/apikey/verify", url.Values{})
+
+	masterAPIKey := putTestRedoxCredentials(t, h, &RedoxCredentials{Username: "redoxtest"})
+
+	for _, disabled := range []bool{false, true} {
+		apiKey := putTestRedoxCredentials(t, h, &RedoxCredentials{
+			Disabled:     disabled,
+			MasterAPIKey: masterAPIKey,
+			Username:     "redoxtest",
+		})
+
+		h, _ := newTestHandlerArgs(t, "POST", "/redox/apikey/verify", url.Values{
+			"apiKeyOrMasterAPIKey": {apiKey},
+		})
+
+		response, _ := redoxVerifyAPIKey(h)
+
+		var o map[string]interface{}
+		if err := json.Unmarshal([]byte(response.(string)), &o); err != nil {
+			t.Fatal(err)
+		}
+
+		if o["isValid"] != !disabled {
+			t.Errorf("disabled=%v: expected isValid=%v, got %v", disabled, !disabled, o["isValid"])
+		}
+		if disabled && o["disabled"] != true {
+			t.Errorf("expected disabled flag, got %v", o)
+		}
+	}
+}
+
+func TestRedoxMasterUsageShards(t *testing.T) {
+	h, _ := newTestHandlerArgs(t, "POST", "/redox/execute", url.Values{})
+
+	masterCredentials := &RedoxCredentials{DailyQuota: 5, RateLimit: -1, Username: "redoxtest"}
+	masterAPIKey := putTestRedoxCredentials(t, h, masterCredentials)
+
+	/* Spread across child keys, as in production, so that only the master's limits apply */
+	for i := 0; i < 6; i++ {
+		redoxCredentials := &RedoxCredentials{MasterAPIKey: masterAPIKey, Username: "redoxtest"}
+		putTestRedoxCredentials(t, h, redoxCredentials)
+
+		_, err := consumeRedoxUsage(h, []*RedoxCredentials{masterCredentials, redoxCredentials})
+
+		if i < 5 && err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if i == 5 && err != errRedoxRateLimited {
+			t.Fatalf("expected the daily quota to apply across shards, got %v", err)
+		}
+	}
+
+	h, _ = newTestHandlerArgs(t, "POST", "/redox/usage", url.Values{"masterAPIKey": {masterAPIKey}})
+
+	response, responseCode := redoxGetUsage(h)
+	if responseCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", responseCode, response)
+	}
+
+	usage := response.(map[string]interface{})
+
+	if dailyCount := usage["master"].(map[string]interface{})["dailyCount"]; dailyCount != int64(5) {
+		t.Errorf("expected master dailyCount 5, got %v", dailyCount)
+	}
+	if apiKeys := usage["apiKeys"].([]map[string]interface{}); len(apiKeys) != 6 {
+		t.Errorf("expected 6 child keys, got %d", len(apiKeys))
+	}
+}
+
+func TestRedoxListEventsHidesMasterAPIKey(t *testing.T) {
+	originalRedoxKeyEncryptionKeys := redoxKeyEncryptionKeys
+	redoxKeyEncryptionKeys = RedoxKeyEncryptionKeys{
+		CurrentID: "redoxtest",
+		Keys:      map[string][]byte{"redoxtest": []byte(generateRandomID()[0:32])},
+	}
+	defer func() { redoxKeyEncryptionKeys = originalRedoxKeyEncryptionKeys }()
+
+	h, _ := newTestHandlerArgs(t, "POST", "/redox/webhook", url.Values{})
+
+	masterAPIKey := putTestRedoxCredentials(t, h, &RedoxCredentials{Username: "redoxtest"})
+	apiKey := putTestRedoxCredentials(t, h, &RedoxCredentials{MasterAPIKey: masterAPIKey, Username: "redoxtest"})
+
+	h, _ = newTestHandlerArgs(t, "POST", "/redox/webhook", url.Values{"masterAPIKey": {masterAPIKey}})
+
+	webhook, responseCode := redoxSetUpWebhook(h)
+	if responseCode != http.StatusOK {
+		t.Fatalf("set up webhook: %d %v", responseCode, webhook)
+	}
+
+	webhookURL := webhook.(map[string]string)["url"]
+
+	for i := 0; i < 2; i++ {
+		h, _ = newTestHandlerArgs(t, "POST", webhookURL, url.Values{})
+		h.Request = httptest.NewRequest(
+			"POST",
+			webhookURL,
+			strings.NewReader(`{"Meta": {"DataModel": "Scheduling", "EventType": "New"}, "Visit": {"VisitNumber": "1236"}}`),
+		)
+		h.Request.Header.Set("verification-token", webhook.(map[string]string)["verificationToken"])
+		h.Vars["id"] = webhookURL[strings.LastIndex(webhookURL, "/")+1:]
+
+		if response, responseCode := redoxReceiveWebhook(h); responseCode != http.StatusOK {
+			t.Fatalf("receive webhook: %d %v", responseCode, response)
+		}
+	}
+
+	/* A page size of one returns a cursor, which encodes a key name too */
+	h, _ = newTestHandlerArgs(t, "POST", "/redox/events", url.Values{
+		"apiKeyOrMasterAPIKey": {apiKey},
+		"limit":                {"1"},
+	})
+
+	response, responseCode := redoxListEvents(h)
+	if responseCode != http.StatusOK {
+		t.Fatalf("list events: %d %v", responseCode, response)
+	}
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `"VisitNumber":"1236"`) {
+		t.Fatalf("expected the received event, got %s", b)
+	}
+	if strings.Contains(string(b), masterAPIKey) {
+		t.Errorf("master API key exposed to child key: %s", b)
+	}
+}
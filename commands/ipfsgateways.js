@@ -25,22 +25,30 @@ export const ipfsGateways = memoize(async () => {
 	return (await Promise.all(
 		gatewayURLs.map(async url => {
 			try {
+				/* One entry per distinct location, for geo-proximity selection in the backend */
 				return Array.from(
 					new Set(
 						await Promise.all(
 							(await dns.promises.resolve(
 								new URL(url.replace(':hash.ipfs.', '')).host
-							)).map(async ip =>
-								(
-									(await lookup).get(ip) || {
-										continent: {code: 'na'}
-									}
-								).continent.code.toLowerCase()
-							)
+							)).map(async ip => {
+								const o = (await lookup).get(ip) || {
+									continent: {code: 'na'}
+								};
+
+								return JSON.stringify({
+									continentCode: o.continent.code.toLowerCase(),
+									countryCode: o.country ?
+										o.country.iso_code.toLowerCase() :
+										'',
+									latitude: o.location ? o.location.latitude : 0,
+									longitude: o.location ? o.location.longitude : 0
+								});
+							})
 						)
 					)
-				).map(continentCode => ({
-					continentCode,
+				).map(location => ({
+					...JSON.parse(location),
 					url
 				}));
 			}
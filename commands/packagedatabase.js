@@ -4,6 +4,7 @@ import {getMeta} from '../modules/base.js';
 const {isCLI} = getMeta(import.meta);
 
 import childProcess from 'child_process';
+import crypto from 'crypto';
 import fs from 'fs';
 import glob from 'glob/sync.js';
 import os from 'os';
@@ -15,10 +16,58 @@ const repoPath = `${os.homedir()}/.cyph/repos/cdn`;
 const options = {cwd: repoPath};
 const globOptions = {cwd: repoPath, symlinks: true};
 
+/* {"id": "...", "privateKey": "<Ed25519 PKCS #8 PEM>"}; its public key must be pinned in the backend */
+const signingKeyPath = `${os.homedir()}/.cyph/package-signing-key.json`;
+
+/* Must match getPackageSigningMessage in backend/helpers.go */
+const canonicalJSON = o =>
+	typeof o !== 'object' || o === null ?
+		JSON.stringify(o) :
+	o instanceof Array ?
+		`[${o.map(canonicalJSON).join(',')}]` :
+		`{${Object.keys(o)
+			.sort()
+			.map(k => `${JSON.stringify(k)}:${canonicalJSON(o[k])}`)
+			.join(',')}}`;
+
+/* Without the key, packages are left unsigned, and the backend will refuse to serve them */
+const signPackages = packages => {
+	if (!fs.existsSync(signingKeyPath)) {
+		console.error(
+			`${signingKeyPath} not found; package database will not be signed.`
+		);
+
+		return packages;
+	}
+
+	const {id, privateKey} = JSON.parse(
+		fs.readFileSync(signingKeyPath).toString()
+	);
+
+	for (const [packageName, packageData] of Object.entries(packages)) {
+		const message = canonicalJSON({
+			name: packageName,
+			package: packageData.package,
+			timestamp: packageData.timestamp,
+			uptime: {
+				integrityHash: packageData.uptime.integrityHash || '',
+				ipfsHash: packageData.uptime.ipfsHash || ''
+			}
+		});
+
+		packageData.keyID = id;
+		packageData.signature = crypto
+			.sign(null, Buffer.from(message), privateKey)
+			.toString('base64');
+	}
+
+	return packages;
+};
+
 export const packageDatabase = () => {
 	updateRepos();
 
-	return glob('**/pkg.gz', globOptions)
+	return signPackages(glob('**/pkg.gz', globOptions)
 		.map(pkg => [
 			pkg
 				.split('/')
@@ -41,11 +90,17 @@ export const packageDatabase = () => {
 				path.join(repoPath, pkg.slice(0, -6) + 'current.ipfs')
 			) ?
 				{
-					integrityHash: fs
-						.readFileSync(
-							path.join(repoPath, pkg.slice(0, -6) + 'current.br')
+					integrityHash: `sha512-${crypto
+						.createHash('sha512')
+						.update(
+							fs.readFileSync(
+								path.join(
+									repoPath,
+									pkg.slice(0, -6) + 'current.br'
+								)
+							)
 						)
-						.toString('hex'),
+						.digest('base64')}`,
 					ipfsHash: fs
 						.readFileSync(
 							path.join(
@@ -88,7 +143,7 @@ export const packageDatabase = () => {
 				}
 			}),
 			{}
-		);
+		));
 };
 
 if (isCLI) {
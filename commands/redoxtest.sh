@@ -0,0 +1,278 @@
+#!/bin/bash
+
+
+cd $(cd "$(dirname "$0")" ; pwd)/..
+
+
+# Runs the Redox credential → token → query → log path against redoxsandbox
+
+backendPort=42010
+datastorePort=43010
+sandboxPort=43000
+backendURL="http://localhost:${backendPort}"
+sandboxURL="http://localhost:${sandboxPort}"
+
+cyphAdminKey="$(openssl rand -hex 32)"
+redoxKeyEncryptionKey="$(openssl rand -base64 32)"
+username='redoxtest'
+
+
+cleanup () {
+	kill ${sandboxPID} ${backendPID} ${datastorePID} 2> /dev/null
+	rm -rf backend/.redoxtest.yaml backend/.redoxtest.mod backend/.redoxtest.sum /tmp/cyph-redoxtest
+}
+trap cleanup EXIT
+
+expect () {
+	description="${1}"
+	pattern="${2}"
+	response="${3}"
+
+	if ! echo "${response}" | grep -qP -- "${pattern}" ; then
+		fail "${description}: expected ${pattern}, got ${response}"
+	fi
+
+	log "${description}: OK"
+}
+
+post () {
+	path="${1}"
+	shift
+	curl -s -X POST "${@}" "${backendURL}${path}"
+}
+
+sandboxStat () {
+	curl -s "${sandboxURL}/sandbox/stats" | grep -oP "\"${1}\":\\d+" | grep -oP '\d+$' || echo 0
+}
+
+waitForPort () {
+	for i in {1..120} ; do
+		if curl -s "http://localhost:${1}" > /dev/null ; then
+			return 0
+		fi
+		sleep 1
+	done
+
+	fail "Timed out waiting for port ${1}"
+}
+
+
+cd redoxsandbox
+PORT=${sandboxPort} go run . &
+sandboxPID=$!
+cd ..
+
+cp -f backend/app.yaml backend/.redoxtest.yaml
+# dev_appserver.py only runs go111 apps; same workaround as serve.sh
+sed -i 's/runtime: go11[0-9]/runtime: go111/g' backend/.redoxtest.yaml
+cat >> backend/.redoxtest.yaml << EndOfMessage
+env_variables:
+  CYPH_ADMIN_KEY: '${cyphAdminKey}'
+  REDOX_BASE_URL: '${sandboxURL}'
+  REDOX_KEY_ENCRYPTION_KEYS: 'redoxtest:${redoxKeyEncryptionKey}'
+  REDOX_LOG_HASH_SECRET: '$(openssl rand -hex 32)'
+EndOfMessage
+
+dev_appserver.py \
+	--skip_sdk_update_check \
+	--port ${backendPort} \
+	--admin_port 6010 \
+	--host 0.0.0.0 \
+	--storage_path /tmp/cyph-redoxtest \
+	--support_datastore_emulator=True \
+	${PWD}/backend/.redoxtest.yaml \
+&
+backendPID=$!
+
+waitForPort ${sandboxPort}
+waitForPort ${backendPort}
+
+
+log 'Credentials'
+
+masterAPIKey="$(curl -s -X PUT \
+	--data-urlencode "cyphAdminKey=${cyphAdminKey}" \
+	--data-urlencode 'redoxAPIKey=sandbox-api-key' \
+	--data-urlencode 'redoxSecret=sandbox-secret' \
+	--data-urlencode "username=${username}" \
+	"${backendURL}/redox/credentials"
+)"
+expect 'Add credentials' '^[0-9a-f]+$' "${masterAPIKey}"
+
+apiKey="$(post /redox/apikey/generate \
+	--data-urlencode "masterAPIKey=${masterAPIKey}" \
+	--data-urlencode "username=${username}" \
+	--data-urlencode 'label=redoxtest' \
+	--data-urlencode 'allowedDataModels=PatientSearch,Scheduling'
+)"
+expect 'Generate child API key' '^[0-9a-f]+$' "${apiKey}"
+
+expect 'Reject unknown master API key' 'invalid master API key' "$(post /redox/apikey/generate \
+	--data-urlencode 'masterAPIKey=nope' \
+	--data-urlencode "username=${username}"
+)"
+
+expect 'List child API keys' "\"apiKey\":\"${apiKey}\"" "$(post /redox/apikey/list \
+	--data-urlencode "masterAPIKey=${masterAPIKey}"
+)"
+
+
+log 'Token and query'
+
+patientSearch='{"Meta": {"DataModel": "PatientSearch", "EventType": "Query", "Destinations": [{"ID": "sandbox"}]}, "Patient": {"Identifiers": [{"ID": "0000000001", "IDType": "MR"}]}}'
+
+expect 'Run query' '"LastName":\s*"Bixby"' "$(post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}"
+)"
+expect 'Authenticate once' '^1$' "$(sandboxStat authenticate)"
+
+post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}" \
+> /dev/null
+expect 'Reuse cached token' '^1$' "$(sandboxStat authenticate)"
+
+expect 'Reject invalid command' '"field":"Meta.EventType"' "$(post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode 'redoxCommand={"Meta": {"DataModel": "PatientSearch"}}'
+)"
+
+expect 'Reject disallowed data model' 'data model not allowed' "$(post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode 'redoxCommand={"Meta": {"DataModel": "Notes", "EventType": "Query", "Destinations": [{"ID": "sandbox"}]}, "Patients": [{}]}'
+)"
+
+expect 'Invalid commands never reach Redox' '^2$' "$(sandboxStat query)"
+
+curl -s -X POST "${sandboxURL}/sandbox/revoke" > /dev/null
+post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}" \
+> /dev/null
+expect 'Run query after token revocation' '"LastName":\s*"Bixby"' "$(post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}"
+)"
+expect 'Refresh revoked token' '^1$' "$(sandboxStat refreshToken)"
+
+
+log 'FHIR'
+
+fhir () {
+	curl -s \
+		-H "Authorization: Bearer ${apiKey}" \
+		-H 'X-Redox-Destination: sandbox' \
+		"${backendURL}/fhir/${1}"
+}
+
+expect 'Read Patient' '"family":"Bixby".*"resourceType":"Patient"' "$(fhir Patient/0000000001)"
+expect 'Search Patient' '"total":1' "$(fhir 'Patient?family=Bixby&given=Timothy')"
+expect 'Search Appointment' '"id":"0000000001.1234"' "$(fhir 'Appointment?patient=Patient/0000000001')"
+expect 'Read Appointment' '"status":"booked"' "$(fhir Appointment/0000000001.1234)"
+expect 'Scope Appointment reads to the patient' '"code":"not-found"' "$(fhir Appointment/0000000002.1234)"
+expect 'Reject Practitioner for restricted key' 'data model not allowed' "$(fhir Practitioner/4356789876)"
+
+
+log 'Rate limits'
+
+limitedAPIKey="$(post /redox/apikey/generate \
+	--data-urlencode "masterAPIKey=${masterAPIKey}" \
+	--data-urlencode "username=${username}" \
+	--data-urlencode 'rateLimit=1' \
+	--data-urlencode 'rateLimitBurst=1'
+)"
+expect 'Generate rate-limited child API key' '^[0-9a-f]+$' "${limitedAPIKey}"
+
+post /redox/execute \
+	--data-urlencode "apiKeyOrMasterAPIKey=${limitedAPIKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}" \
+> /dev/null
+throttledResponse="$(post /redox/execute -i \
+	--data-urlencode "apiKeyOrMasterAPIKey=${limitedAPIKey}" \
+	--data-urlencode "redoxCommand=${patientSearch}"
+)"
+expect 'Throttle over-limit calls' '^HTTP/\S+ 429' "${throttledResponse}"
+expect 'Send Retry-After' '^Retry-After: \d+' "${throttledResponse}"
+
+expect 'Report usage' "\"apiKey\":\"${limitedAPIKey}\",\"dailyCount\":1" "$(post /redox/usage \
+	--data-urlencode "masterAPIKey=${masterAPIKey}"
+)"
+
+
+log 'Webhook'
+
+webhook="$(post /redox/webhook --data-urlencode "masterAPIKey=${masterAPIKey}")"
+webhookURL="$(echo "${webhook}" | grep -oP '"url":"\K[^"]+' | sed "s|^http://localhost:[0-9]*|${backendURL}|")"
+verificationToken="$(echo "${webhook}" | grep -oP '"verificationToken":"\K[^"]+')"
+expect 'Set up webhook' '^[0-9a-f]+$' "${verificationToken}"
+
+expect 'Answer verification challenge' '^redoxtest-challenge$' "$(curl -s -X POST \
+	-d "{\"verification-token\": \"${verificationToken}\", \"challenge\": \"redoxtest-challenge\"}" \
+	"${webhookURL}"
+)"
+
+schedulingNew='{"Meta": {"DataModel": "Scheduling", "EventType": "New"}, "Visit": {"VisitNumber": "1236"}}'
+
+expect 'Reject invalid verification token' '^401$' "$(curl -s -o /dev/null -w '%{http_code}' -X POST \
+	-H 'verification-token: nope' \
+	-d "${schedulingNew}" \
+	"${webhookURL}"
+)"
+
+curl -s -X POST \
+	-H "verification-token: ${verificationToken}" \
+	-d "${schedulingNew}" \
+	"${webhookURL}" \
+> /dev/null
+
+events="$(post /redox/events \
+	--data-urlencode "apiKeyOrMasterAPIKey=${apiKey}"
+)"
+expect 'Fetch inbound events' '"VisitNumber":\s*"1236"' "${events}"
+if echo "${events}" | grep -q "${masterAPIKey}" ; then
+	fail "Events expose the master API key to a child key: ${events}"
+fi
+
+
+log 'Request log'
+
+logs="$(post /redox/logs \
+	--data-urlencode "masterAPIKey=${masterAPIKey}" \
+	--data-urlencode "username=${username}"
+)"
+expect 'Log requests' '"DataModel":"PatientSearch"' "${logs}"
+expect 'Redact PHI from logs' 'redacted:' "${logs}"
+if echo "${logs}" | grep -q 'Bixby' ; then
+	fail "Request log contains PHI: ${logs}"
+fi
+
+
+log 'Go tests'
+
+gcloud beta emulators datastore start \
+	--host-port=localhost:${datastorePort} \
+	--no-store-on-disk \
+	--project=test \
+&
+datastorePID=$!
+
+waitForPort ${datastorePort}
+
+# The backend's module file is checked in as .go.mod (see copyworkspace.sh)
+cp -f backend/.go.mod backend/.redoxtest.mod
+cd backend
+if ! \
+	DATASTORE_EMULATOR_HOST="localhost:${datastorePort}" \
+	DATASTORE_PROJECT_ID=test \
+	REDOX_BASE_URL="${sandboxURL}" \
+	REDOX_KEY_ENCRYPTION_KEYS="redoxtest:${redoxKeyEncryptionKey}" \
+	RUN_WITH_DEVAPPSERVER=1 \
+	go test -mod=mod -modfile=.redoxtest.mod -vet=off . \
+; then
+	fail 'Go tests failed'
+fi
+cd ..
+
+
+pass
@@ -0,0 +1,3 @@
+module redoxsandbox
+
+go 1.15
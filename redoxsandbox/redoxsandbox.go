@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Local stand-in for the Redox API; not deployed */
+
+type sandboxToken struct {
+	AccessToken  string
+	Expires      time.Time
+	RefreshToken string
+}
+
+var apiKey = getEnv("REDOX_SANDBOX_API_KEY", "sandbox-api-key")
+var secret = getEnv("REDOX_SANDBOX_SECRET", "sandbox-secret")
+
+/* Must exceed the backend's RedoxAuthExpirationBuffer, or every request will refresh */
+var tokenLifetime = time.Hour * time.Duration(24)
+
+var state = struct {
+	sync.Mutex
+	accessTokens  map[string]*sandboxToken
+	refreshTokens map[string]*sandboxToken
+	stats         map[string]int
+}{
+	accessTokens:  map[string]*sandboxToken{},
+	refreshTokens: map[string]*sandboxToken{},
+	stats:         map[string]int{},
+}
+
+var patients = []map[string]interface{}{
+	map[string]interface{}{
+		"Identifiers": []interface{}{
+			map[string]interface{}{"ID": "0000000001", "IDType": "MR"},
+			map[string]interface{}{"ID": "e167267c-16c9-4fe3-96ae-9cff5703e90a", "IDType": "EHRID"},
+		},
+		"Demographics": map[string]interface{}{
+			"FirstName":  "Timothy",
+			"MiddleName": "Paul",
+			"LastName":   "Bixby",
+			"DOB":        "2008-01-06",
+			"Sex":        "Male",
+			"Address": map[string]interface{}{
+				"StreetAddress": "4762 Hickory Street",
+				"City":          "Monroe",
+				"State":         "WI",
+				"ZIP":           "53566",
+				"County":        "Green",
+				"Country":       "US",
+			},
+			"PhoneNumber": map[string]interface{}{
+				"Home":   "+18088675301",
+				"Mobile": "+18088675303",
+			},
+			"EmailAddresses": []interface{}{"timothy.bixby@example.com"},
+		},
+	},
+	map[string]interface{}{
+		"Identifiers": []interface{}{
+			map[string]interface{}{"ID": "0000000002", "IDType": "MR"},
+		},
+		"Demographics": map[string]interface{}{
+			"FirstName": "Barbara",
+			"LastName":  "Bixby",
+			"DOB":       "1982-03-14",
+			"Sex":       "Female",
+			"PhoneNumber": map[string]interface{}{
+				"Office": "+18088675302",
+			},
+		},
+	},
+}
+
+var providers = []map[string]interface{}{
+	map[string]interface{}{
+		"ID":          "4356789876",
+		"IDType":      "NPI",
+		"FirstName":   "Pat",
+		"LastName":    "Granite",
+		"Credentials": []interface{}{"MD"},
+		"Address": map[string]interface{}{
+			"StreetAddress": "123 Main St.",
+			"City":          "Madison",
+			"State":         "WI",
+			"ZIP":           "53703",
+		},
+		"PhoneNumber": map[string]interface{}{
+			"Office": "+16085551234",
+		},
+	},
+}
+
+/* Visits are scheduled relative to startup so that default date windows find them */
+var visits = func() []map[string]interface{} {
+	today := time.Now().UTC().Truncate(time.Hour * time.Duration(24))
+
+	return []map[string]interface{}{
+		map[string]interface{}{
+			"VisitNumber":   "1234",
+			"VisitDateTime": today.Add(time.Hour * time.Duration(24+14)).Format(time.RFC3339),
+			"Duration":      15,
+			"Status":        "Scheduled",
+			"Reason":        "Annual physical",
+			"Patient":       map[string]interface{}{"Identifiers": patients[0]["Identifiers"]},
+			"VisitProvider": providers[0],
+			"Location":      map[string]interface{}{"Facility": "RES General Hospital", "Department": "3N"},
+		},
+		map[string]interface{}{
+			"VisitNumber":   "1235",
+			"VisitDateTime": today.Add(time.Hour * time.Duration(48+9)).Format(time.RFC3339),
+			"Duration":      30,
+			"Status":        "Canceled",
+			"Reason":        "Follow-up",
+			"Patient":       map[string]interface{}{"Identifiers": patients[1]["Identifiers"]},
+			"VisitProvider": providers[0],
+		},
+	}
+}()
+
+func getEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func generateToken() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(bytes)
+}
+
+func getField(node interface{}, path ...string) interface{} {
+	for _, k := range path {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			node = v[k]
+		default:
+			return nil
+		}
+	}
+
+	return node
+}
+
+func getString(node interface{}, path ...string) string {
+	s, _ := getField(node, path...).(string)
+	return s
+}
+
+func getList(node interface{}, path ...string) []interface{} {
+	switch v := getField(node, path...).(type) {
+	case []interface{}:
+		return v
+	}
+
+	return []interface{}{}
+}
+
+/* Round-trips canned data through JSON so that it matches what handlers decode */
+func normalize(o interface{}) interface{} {
+	b, _ := json.Marshal(o)
+
+	var normalized interface{}
+	json.Unmarshal(b, &normalized)
+
+	return normalized
+}
+
+func hasIdentifier(identifiers []interface{}, query []interface{}) bool {
+	for _, q := range query {
+		for _, identifier := range identifiers {
+			if getString(identifier, "ID") == getString(q, "ID") &&
+				(getString(q, "IDType") == "" || getString(identifier, "IDType") == getString(q, "IDType")) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/* Every non-empty string in query must match the same field in o */
+func matchesFields(o interface{}, query interface{}) bool {
+	q, ok := query.(map[string]interface{})
+	if !ok || len(q) < 1 {
+		return false
+	}
+
+	for k, v := range q {
+		if s, ok := v.(string); ok && s != "" && !strings.EqualFold(getString(o, k), s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func findPatient(query interface{}) interface{} {
+	for _, patient := range patients {
+		p := normalize(patient)
+
+		if hasIdentifier(getList(p, "Identifiers"), getList(query, "Identifiers")) ||
+			matchesFields(getField(p, "Demographics"), getField(query, "Demographics")) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, o interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(o)
+}
+
+func writeError(w http.ResponseWriter, status int, meta interface{}, text string) {
+	writeJSON(w, status, map[string]interface{}{
+		"Meta": map[string]interface{}{
+			"DataModel": getString(meta, "DataModel"),
+			"EventType": getString(meta, "EventType"),
+			"Errors":    []interface{}{map[string]interface{}{"Text": text}},
+		},
+	})
+}
+
+func readBody(r *http.Request) map[string]interface{} {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil
+	}
+
+	var o map[string]interface{}
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil
+	}
+
+	return o
+}
+
+func issueToken(w http.ResponseWriter) {
+	token := &sandboxToken{
+		AccessToken:  generateToken(),
+		Expires:      time.Now().Add(tokenLifetime),
+		RefreshToken: generateToken(),
+	}
+
+	state.accessTokens[token.AccessToken] = token
+	state.refreshTokens[token.RefreshToken] = token
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accessToken":  token.AccessToken,
+		"expires":      token.Expires.UTC().Format(time.RFC3339),
+		"refreshToken": token.RefreshToken,
+	})
+}
+
+func authenticate(w http.ResponseWriter, r *http.Request) {
+	body := readBody(r)
+
+	state.Lock()
+	defer state.Unlock()
+
+	state.stats["authenticate"]++
+
+	if getString(body, "apiKey") != apiKey || getString(body, "secret") != secret {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "invalid credentials"})
+		return
+	}
+
+	issueToken(w)
+}
+
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	body := readBody(r)
+
+	state.Lock()
+	defer state.Unlock()
+
+	state.stats["refreshToken"]++
+
+	token, ok := state.refreshTokens[getString(body, "refreshToken")]
+	if getString(body, "apiKey") != apiKey || !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "invalid refresh token"})
+		return
+	}
+
+	delete(state.accessTokens, token.AccessToken)
+	delete(state.refreshTokens, token.RefreshToken)
+
+	issueToken(w)
+}
+
+func query(w http.ResponseWriter, r *http.Request) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	state.Lock()
+	state.stats["query"]++
+	token, ok := state.accessTokens[accessToken]
+	state.Unlock()
+
+	if !ok || time.Now().After(token.Expires) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "invalid access token"})
+		return
+	}
+
+	command := readBody(r)
+	if command == nil {
+		writeError(w, http.StatusBadRequest, nil, "invalid JSON")
+		return
+	}
+
+	meta := getField(command, "Meta")
+	dataModel := getString(meta, "DataModel")
+	eventType := getString(meta, "EventType")
+
+	if len(getList(meta, "Destinations")) < 1 {
+		writeError(w, http.StatusBadRequest, meta, "no destinations specified")
+		return
+	}
+
+	response := map[string]interface{}{
+		"Meta": map[string]interface{}{
+			"DataModel": dataModel,
+			"EventType": eventType,
+			"Message":   map[string]interface{}{"ID": generateToken()},
+			"Source":    map[string]interface{}{"Name": "Redox Sandbox"},
+		},
+	}
+
+	switch dataModel + "." + eventType {
+	case "ClinicalSummary.PatientQuery", "ClinicalSummary.VisitQuery":
+		patient := findPatient(getField(command, "Patient"))
+		if patient == nil {
+			writeError(w, http.StatusBadRequest, meta, "patient not found")
+			return
+		}
+
+		response["Header"] = map[string]interface{}{"Patient": patient}
+		response["Allergies"] = []interface{}{}
+		response["Medications"] = []interface{}{}
+		response["Problems"] = []interface{}{
+			map[string]interface{}{"Name": "Essential hypertension", "Code": "59621000", "CodeSystemName": "SNOMED CT"},
+		}
+
+	case "Notes.Query":
+		response["Notes"] = []interface{}{}
+
+	case "PatientSearch.Query":
+		response["Patient"] = findPatient(getField(command, "Patient"))
+
+	case "Provider.ProviderQuery":
+		matches := []interface{}{}
+
+		for _, provider := range providers {
+			p := normalize(provider)
+
+			for _, q := range getList(command, "Providers") {
+				if hasIdentifier([]interface{}{p}, []interface{}{q}) || matchesFields(p, q) {
+					matches = append(matches, p)
+					break
+				}
+			}
+		}
+
+		response["Providers"] = matches
+
+	case "Results.Query":
+		response["Orders"] = []interface{}{}
+
+	case "Scheduling.AvailableSlots":
+		start, _ := time.Parse(time.RFC3339, getString(command, "StartDateTime"))
+
+		slots := []interface{}{}
+		for i := 0; i < 4; i++ {
+			slots = append(slots, map[string]interface{}{
+				"DateTime": start.Add(time.Minute * time.Duration(30*i)).UTC().Format(time.RFC3339),
+				"Duration": 30,
+				"Provider": normalize(providers[0]),
+			})
+		}
+
+		response["AvailableSlots"] = slots
+
+	case "Scheduling.Booked":
+		start, startErr := time.Parse(time.RFC3339, getString(command, "StartDateTime"))
+		end, endErr := time.Parse(time.RFC3339, getString(command, "EndDateTime"))
+
+		if startErr != nil || endErr != nil {
+			writeError(w, http.StatusBadRequest, meta, "invalid StartDateTime or EndDateTime")
+			return
+		}
+
+		patientQuery := getList(command, "Patients")
+		matches := []interface{}{}
+
+		for _, visit := range visits {
+			v := normalize(visit)
+
+			visitDateTime, _ := time.Parse(time.RFC3339, getString(v, "VisitDateTime"))
+			if visitDateTime.Before(start) || visitDateTime.After(end) {
+				continue
+			}
+
+			if len(patientQuery) > 0 &&
+				!hasIdentifier(getList(v, "Patient", "Identifiers"), getList(patientQuery[0], "Identifiers")) {
+				continue
+			}
+
+			matches = append(matches, v)
+		}
+
+		response["Visits"] = matches
+
+	default:
+		writeError(w, http.StatusBadRequest, meta, "unsupported data model "+dataModel+"."+eventType)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+/* Invalidates access tokens, but not refresh tokens, to exercise the refresh path */
+func revoke(w http.ResponseWriter, r *http.Request) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.accessTokens = map[string]*sandboxToken{}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+func stats(w http.ResponseWriter, r *http.Request) {
+	state.Lock()
+	defer state.Unlock()
+
+	writeJSON(w, http.StatusOK, state.stats)
+}
+
+func main() {
+	http.HandleFunc("/auth/authenticate", authenticate)
+	http.HandleFunc("/auth/refreshToken", refreshToken)
+	http.HandleFunc("/query", query)
+	http.HandleFunc("/sandbox/revoke", revoke)
+	http.HandleFunc("/sandbox/stats", stats)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "43000"
+	}
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+}